@@ -0,0 +1,228 @@
+package rpch
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// priorityKey is the metadata key of the request priority.
+const priorityKey = "rpch-priority"
+
+// Priority decides which requests are shed first by AdaptiveLimiter.
+type Priority int8
+
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityCritical
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityCritical:
+		return "critical"
+	}
+	return "normal"
+}
+
+func parsePriority(s string) Priority {
+	switch s {
+	case "low":
+		return PriorityLow
+	case "critical":
+		return PriorityCritical
+	}
+	return PriorityNormal
+}
+
+// share is the part of the limit available to the requests of the priority.
+func (p Priority) share() float64 {
+	switch p {
+	case PriorityLow:
+		return 0.5
+	case PriorityCritical:
+		return 1
+	}
+	return 0.9
+}
+
+// WithPriority returns a context whose calls carry the priority p in metadata.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return AppendToOutgoingContext(ctx, priorityKey, p.String())
+}
+
+// PriorityFromContext returns the priority claimed by the client in the context
+// of a handler, PriorityNormal if the client does not set it. The priority is
+// not authenticated, see AdaptiveConfig.Priority.
+func PriorityFromContext(ctx context.Context) Priority {
+	return parsePriority(IncomingMetadata(ctx).Get(priorityKey))
+}
+
+// AdaptiveConfig configures an AdaptiveLimiter, the zero values of fields take
+// the defaults.
+type AdaptiveConfig struct {
+	// InitialLimit, MinLimit and MaxLimit bound the number of concurrent
+	// requests, 20, 1 and 1000 by default.
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// Tolerance is how many times the baseline latency of its method a request
+	// can take before the server is seen as queueing, 2 by default.
+	Tolerance float64
+	// Backoff multiplies the limit when the server is queueing, 0.9 by default.
+	Backoff float64
+	// Window is the period the baseline latency of each method, which is the
+	// min latency in the last two windows, is measured in, 10s by default.
+	Window time.Duration
+	// Priority decides the priority of a request from the one claimed by the
+	// client, which any client can set. ctx carries the principal if the
+	// server authenticates requests, so that only trusted clients get
+	// PriorityCritical. The claimed priority is used if it is nil.
+	Priority func(ctx context.Context, claimed Priority) Priority
+}
+
+// AdaptiveLimiter limits the concurrent requests of a Server by AIMD: the limit
+// grows by one every limit requests finished in time, and is multiplied by
+// Backoff when the latency of handlers rises beyond Tolerance times the
+// baseline. Each method has its own baseline, so a slow method does not make a
+// fast one look queueing. The rejected requests get error responses with
+// CodeOverloaded, which is retryable by DefaultRetryPolicy.
+//
+// Requests with PriorityLow may use half of the limit, PriorityNormal 90% and
+// PriorityCritical the whole, so critical requests are shed last. The priority
+// is claimed by the client unless AdaptiveConfig.Priority decides it. Set it to
+// Server.AdaptiveLimiter.
+type AdaptiveLimiter struct {
+	config   AdaptiveConfig
+	lock     sync.Mutex
+	limit    float64
+	inflight int
+	//the baselines by Service.Method
+	baselines    map[methodKey]*latencyBaseline
+	lastDecrease time.Time
+}
+
+// latencyBaseline is the min latency of a method in the current and the
+// previous window.
+type latencyBaseline struct {
+	min         time.Duration
+	prevMin     time.Duration
+	windowStart time.Time
+}
+
+// update adds the latency to the window and returns the baseline.
+func (b *latencyBaseline) update(latency time.Duration, now time.Time, window time.Duration) time.Duration {
+	if now.Sub(b.windowStart) >= window {
+		b.prevMin, b.min = b.min, 0
+		b.windowStart = now
+	}
+	if b.min == 0 || latency < b.min {
+		b.min = latency
+	}
+	if b.prevMin != 0 && b.prevMin < b.min {
+		return b.prevMin
+	}
+	return b.min
+}
+
+func NewAdaptiveLimiter(config AdaptiveConfig) *AdaptiveLimiter {
+	if config.MinLimit <= 0 {
+		config.MinLimit = 1
+	}
+	if config.MaxLimit <= 0 {
+		config.MaxLimit = 1000
+	}
+	if config.InitialLimit <= 0 {
+		config.InitialLimit = 20
+	}
+	if config.Tolerance <= 1 {
+		config.Tolerance = 2
+	}
+	if config.Backoff <= 0 || config.Backoff >= 1 {
+		config.Backoff = 0.9
+	}
+	if config.Window <= 0 {
+		config.Window = 10 * time.Second
+	}
+	al := &AdaptiveLimiter{config: config, baselines: make(map[methodKey]*latencyBaseline)}
+	al.limit = al.clamp(float64(config.InitialLimit))
+	return al
+}
+
+func (al *AdaptiveLimiter) clamp(limit float64) float64 {
+	return math.Max(float64(al.config.MinLimit), math.Min(float64(al.config.MaxLimit), limit))
+}
+
+// Limit returns the current limit of concurrent requests.
+func (al *AdaptiveLimiter) Limit() int {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	return int(al.limit)
+}
+
+// Inflight returns the number of requests being handled.
+func (al *AdaptiveLimiter) Inflight() int {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	return al.inflight
+}
+
+// admit reports whether req can be handled now. If it can, done should be
+// called after the handler returns. It does nothing on a nil AdaptiveLimiter.
+func (al *AdaptiveLimiter) admit(req *request) (done func(), err error) {
+	if al == nil {
+		return func() {}, nil
+	}
+	priority := parsePriority(req.metadata.Get(priorityKey))
+	if al.config.Priority != nil {
+		priority = al.config.Priority(req.ctx, priority)
+	}
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if float64(al.inflight) >= math.Ceil(al.limit*priority.share()) {
+		return nil, Errorf(CodeOverloaded, "rpch: server overloaded, %s priority request rejected", priority)
+	}
+	al.inflight++
+	start := time.Now()
+	//the latency of streams depends on the client, and the requests of unknown
+	//methods, which fail at once, would grow the baselines without bound
+	sample := req.streamingArg == nil && req.conn.svr.lookupMethod(req.service, req.method) != nil
+	key := methodKey{req.service, req.method}
+	return func() {
+		al.onDone(key, time.Since(start), sample)
+	}, nil
+}
+
+func (al *AdaptiveLimiter) onDone(key methodKey, latency time.Duration, sample bool) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	inflight := al.inflight
+	al.inflight--
+	if !sample {
+		return
+	}
+	now := time.Now()
+	b, ok := al.baselines[key]
+	if !ok {
+		b = &latencyBaseline{windowStart: now}
+		al.baselines[key] = b
+	}
+	baseline := b.update(latency, now, al.config.Window)
+	if float64(latency) > al.config.Tolerance*float64(baseline) {
+		//the requests admitted before the decrease are still slow, decrease
+		//at most once per latency
+		if now.Sub(al.lastDecrease) >= latency {
+			al.limit = al.clamp(al.limit * al.config.Backoff)
+			al.lastDecrease = now
+		}
+		return
+	}
+	//increase only when the limit is in use
+	if float64(inflight) >= al.limit/2 {
+		al.limit = al.clamp(al.limit + 1/al.limit)
+	}
+}
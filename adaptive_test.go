@@ -0,0 +1,147 @@
+package rpch
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type adaptiveTestService struct{}
+
+func (adaptiveTestService) Fast() error { return nil }
+
+func (adaptiveTestService) Slow() error { return nil }
+
+// adaptiveRequest returns a request of S.method served by svr, claiming the
+// priority if it is not empty.
+func adaptiveRequest(svr *Server, method, priority string) *request {
+	req := testRequest("S", method, "10.0.0.1:1")
+	req.conn.svr = svr
+	if priority != "" {
+		req.metadata.Set(priorityKey, priority)
+	}
+	return req
+}
+
+func adaptiveServer(t *testing.T) *Server {
+	t.Helper()
+	svr := NewServer()
+	if err := RegisterImpl(svr, "S", adaptiveTestService{}); err != nil {
+		t.Fatal(err)
+	}
+	return svr
+}
+
+// finish feeds a request of key finished after latency to al.
+func finish(al *AdaptiveLimiter, key methodKey, latency time.Duration) {
+	al.lock.Lock()
+	al.inflight++
+	al.lock.Unlock()
+	al.onDone(key, latency, true)
+}
+
+func TestAdaptiveLimiterMixedLatency(t *testing.T) {
+	al := NewAdaptiveLimiter(AdaptiveConfig{})
+	fast, slow := methodKey{"S", "Fast"}, methodKey{"S", "Slow"}
+	for i := 0; i < 100; i++ {
+		finish(al, fast, time.Millisecond)
+		finish(al, slow, 50*time.Millisecond)
+	}
+	//a method slower than another is not queueing
+	if got := al.Limit(); got != 20 {
+		t.Fatalf("limit %d after mixed traffic, want 20", got)
+	}
+	//the method slowing down is
+	finish(al, fast, 10*time.Millisecond)
+	if got := al.Limit(); got != 18 {
+		t.Fatalf("limit %d after a queueing request, want 18", got)
+	}
+}
+
+func TestAdaptiveLimiterIncrease(t *testing.T) {
+	al := NewAdaptiveLimiter(AdaptiveConfig{InitialLimit: 4})
+	key := methodKey{"S", "Fast"}
+	//the limit only grows when it is in use
+	finish(al, key, time.Millisecond)
+	if got := al.Limit(); got != 4 {
+		t.Fatalf("limit %d after an idle request, want 4", got)
+	}
+	al.lock.Lock()
+	al.inflight = 2
+	al.lock.Unlock()
+	//the limit grows by 1/limit for each request
+	for i := 0; i < 5; i++ {
+		finish(al, key, time.Millisecond)
+	}
+	if got := al.Limit(); got != 5 {
+		t.Fatalf("limit %d after 5 requests in use, want 5", got)
+	}
+}
+
+func TestAdaptiveLimiterPriority(t *testing.T) {
+	svr := adaptiveServer(t)
+	al := NewAdaptiveLimiter(AdaptiveConfig{InitialLimit: 10})
+	admit := func(priority string) error {
+		_, err := al.admit(adaptiveRequest(svr, "Fast", priority))
+		return err
+	}
+	//low takes at most 5, normal 9 and critical all the 10
+	for i := 0; i < 5; i++ {
+		if err := admit("low"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := admit("low"); ErrorCode(err) != CodeOverloaded {
+		t.Fatalf("got %v, want overloaded beyond the share of low", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := admit(""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := admit(""); ErrorCode(err) != CodeOverloaded {
+		t.Fatalf("got %v, want overloaded beyond the share of normal", err)
+	}
+	if err := admit("critical"); err != nil {
+		t.Fatal(err)
+	}
+	if err := admit("critical"); ErrorCode(err) != CodeOverloaded {
+		t.Fatalf("got %v, want overloaded beyond the limit", err)
+	}
+	if got := al.Inflight(); got != 10 {
+		t.Fatalf("inflight %d, want 10", got)
+	}
+}
+
+func TestAdaptiveLimiterPriorityHook(t *testing.T) {
+	svr := adaptiveServer(t)
+	al := NewAdaptiveLimiter(AdaptiveConfig{
+		InitialLimit: 2,
+		//the clients claiming critical are not trusted
+		Priority: func(ctx context.Context, claimed Priority) Priority {
+			if claimed == PriorityCritical {
+				return PriorityLow
+			}
+			return claimed
+		},
+	})
+	if _, err := al.admit(adaptiveRequest(svr, "Fast", "critical")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := al.admit(adaptiveRequest(svr, "Fast", "critical")); ErrorCode(err) != CodeOverloaded {
+		t.Fatalf("got %v, want the claimed critical treated as low", err)
+	}
+}
+
+func TestAdaptiveLimiterUnknownMethod(t *testing.T) {
+	svr := adaptiveServer(t)
+	al := NewAdaptiveLimiter(AdaptiveConfig{})
+	done, err := al.admit(adaptiveRequest(svr, "Missing", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	if len(al.baselines) != 0 || al.Inflight() != 0 {
+		t.Fatalf("baselines %v, inflight %d after a request of an unknown method", al.baselines, al.Inflight())
+	}
+}
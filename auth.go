@@ -0,0 +1,153 @@
+package rpch
+
+import (
+	"context"
+	"path"
+	"strings"
+)
+
+// authorizationKey is the metadata key of the bearer token.
+const authorizationKey = "authorization"
+
+// TokenSource returns the token sent with each call of a Conn, see WithToken.
+type TokenSource func(ctx context.Context) (string, error)
+
+// StaticToken returns a TokenSource always returning token.
+func StaticToken(token string) TokenSource {
+	return func(context.Context) (string, error) {
+		return token, nil
+	}
+}
+
+// WithToken makes the Conn send the token from src as "Bearer <token>" in the
+// metadata authorization of each call. A call fails with CodeUnauthenticated
+// if src returns an error.
+func WithToken(src TokenSource) DialOption {
+	return func(client *Conn) {
+		client.tokens = src
+	}
+}
+
+// Principal is the identity of an authenticated client.
+type Principal struct {
+	Name  string
+	Roles []string
+}
+
+func (p *Principal) hasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the principal of the request in the context of
+// a handler, which is nil if the client sends no token.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// Authenticator validates the bearer token of a request and returns its
+// principal. ctx carries the metadata of the request. An error without code is
+// sent to the client with CodeUnauthenticated.
+type Authenticator func(ctx context.Context, token string) (*Principal, error)
+
+// AuthRule allows the principals matching Principals or Roles to call the
+// methods matching Methods.
+type AuthRule struct {
+	// Methods are the patterns of "Service.Method" in the syntax of path.Match,
+	// e.g. "File.OpenFile", "File.*" or "*".
+	Methods []string
+	// Principals are the allowed principal names, "*" allows all the
+	// authenticated principals.
+	Principals []string
+	// Roles are the allowed roles.
+	Roles []string
+	// Anonymous allows the requests without token.
+	Anonymous bool
+}
+
+func (r *AuthRule) matchMethod(name string) bool {
+	for _, pattern := range r.Methods {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *AuthRule) allows(p *Principal) bool {
+	if p == nil {
+		return r.Anonymous
+	}
+	for _, name := range r.Principals {
+		if name == "*" || name == p.Name {
+			return true
+		}
+	}
+	for _, role := range r.Roles {
+		if p.hasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthPolicy decides which methods a principal can call. A call is allowed if
+// any rule matching the method allows the principal, so the methods matched by
+// no rule can not be called.
+type AuthPolicy struct {
+	Rules []AuthRule
+}
+
+// Authorize returns an error with CodeUnauthenticated if p is nil and the call
+// is not allowed, or CodePermissionDenied if p is not nil.
+func (ap *AuthPolicy) Authorize(p *Principal, service, method string) error {
+	name := service + "." + method
+	for i := range ap.Rules {
+		if ap.Rules[i].matchMethod(name) && ap.Rules[i].allows(p) {
+			return nil
+		}
+	}
+	if p == nil {
+		return Errorf(CodeUnauthenticated, "rpch: %s requires authentication", name)
+	}
+	return Errorf(CodePermissionDenied, "rpch: %s is not allowed to call %s", p.Name, name)
+}
+
+// authenticate authenticates and authorizes req by the Authenticator and the
+// AuthPolicy of the server, and puts the principal into the context of req.
+func (svr *Server) authenticate(req *request) error {
+	if svr.Authenticator == nil && svr.AuthPolicy == nil {
+		return nil
+	}
+	var p *Principal
+	auth := req.metadata.Get(authorizationKey)
+	if svr.Authenticator != nil && auth != "" {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth {
+			return Errorf(CodeUnauthenticated, "rpch: authorization is not a bearer token")
+		}
+		var err error
+		if p, err = svr.Authenticator(req.ctx, token); err != nil {
+			if ErrorCode(err) == CodeUnknown {
+				return Errorf(CodeUnauthenticated, "rpch: %v", err)
+			}
+			//the error may wrap the one carrying the code
+			return Errorf(ErrorCode(err), "%v", err)
+		}
+		req.ctx = context.WithValue(req.ctx, principalKey{}, p)
+	}
+	if svr.AuthPolicy != nil {
+		return svr.AuthPolicy.Authorize(p, req.service, req.method)
+	}
+	if p == nil {
+		return Errorf(CodeUnauthenticated, "rpch: %s.%s requires authentication", req.service, req.method)
+	}
+	return nil
+}
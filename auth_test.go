@@ -0,0 +1,211 @@
+package rpch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type authTestService struct {
+	//called counts the calls of the handlers
+	called int32
+}
+
+func (s *authTestService) Whoami(ctx context.Context) (string, error) {
+	atomic.AddInt32(&s.called, 1)
+	if p := PrincipalFromContext(ctx); p != nil {
+		return p.Name, nil
+	}
+	return "anonymous", nil
+}
+
+func (s *authTestService) Store(data string) error {
+	atomic.AddInt32(&s.called, 1)
+	return nil
+}
+
+func (s *authTestService) Upload(r io.Reader) (int32, error) {
+	atomic.AddInt32(&s.called, 1)
+	n, err := io.Copy(io.Discard, r)
+	return int32(n), err
+}
+
+func (s *authTestService) Download(w io.Writer) error {
+	atomic.AddInt32(&s.called, 1)
+	_, err := w.Write([]byte("data"))
+	return err
+}
+
+func testAuthenticator(ctx context.Context, token string) (*Principal, error) {
+	switch token {
+	case "alice":
+		return &Principal{Name: "alice", Roles: []string{"user"}}, nil
+	case "root":
+		return &Principal{Name: "root", Roles: []string{"admin"}}, nil
+	case "banned":
+		return nil, fmt.Errorf("token revoked: %w", NewError(CodePermissionDenied, "banned"))
+	}
+	return nil, errors.New("bad token")
+}
+
+type tokenKey struct{}
+
+// contextToken is a TokenSource sending the token in ctx.
+func contextToken(ctx context.Context) (string, error) {
+	token, _ := ctx.Value(tokenKey{}).(string)
+	return token, nil
+}
+
+func withToken(token string) context.Context {
+	return context.WithValue(context.Background(), tokenKey{}, token)
+}
+
+func startAuthServer(t *testing.T) (*authTestService, string) {
+	t.Helper()
+	impl := new(authTestService)
+	_, _, addr := startMuxServer(t, func(svr *Server) {
+		if err := RegisterImpl(svr, "Auth", impl); err != nil {
+			t.Fatal(err)
+		}
+		svr.Authenticator = testAuthenticator
+		svr.AuthPolicy = &AuthPolicy{Rules: []AuthRule{
+			{Methods: []string{"Auth.Whoami"}, Principals: []string{"*"}, Anonymous: true},
+			{Methods: []string{"Auth.*"}, Roles: []string{"admin"}},
+		}}
+	})
+	return impl, addr
+}
+
+// dialAuth dials addr, the calls send the token in their context if tokens is
+// set, or no token at all.
+func dialAuth(t *testing.T, addr string, tokens bool) *Conn {
+	t.Helper()
+	opts := []DialOption{WithLogger(NopLogger)}
+	if tokens {
+		opts = append(opts, WithToken(contextToken))
+	}
+	conn, err := Dial(addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestAuthPolicyAuthorize(t *testing.T) {
+	ap := &AuthPolicy{Rules: []AuthRule{
+		{Methods: []string{"Math.*"}, Anonymous: true},
+		{Methods: []string{"File.Read"}, Principals: []string{"bob"}},
+		{Methods: []string{"File.*"}, Roles: []string{"admin"}},
+	}}
+	bob := &Principal{Name: "bob"}
+	admin := &Principal{Name: "carol", Roles: []string{"admin"}}
+	tests := []struct {
+		p               *Principal
+		service, method string
+		want            Code
+	}{
+		{nil, "Math", "Add", CodeOK},
+		{nil, "File", "Read", CodeUnauthenticated},
+		{bob, "File", "Read", CodeOK},
+		{bob, "File", "Write", CodePermissionDenied},
+		{admin, "File", "Write", CodeOK},
+		//authenticated principals are not anonymous
+		{bob, "Math", "Add", CodePermissionDenied},
+		{admin, "Other", "Call", CodePermissionDenied},
+	}
+	for _, tt := range tests {
+		if got := ErrorCode(ap.Authorize(tt.p, tt.service, tt.method)); got != tt.want {
+			t.Errorf("Authorize(%v, %s.%s) = %v, want %v", tt.p, tt.service, tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	_, addr := startAuthServer(t)
+	conn, anonymous := dialAuth(t, addr, true), dialAuth(t, addr, false)
+	tests := []struct {
+		token  string
+		method string
+		args   []interface{}
+		want   Code
+	}{
+		{"", "Whoami", nil, CodeOK},
+		{"alice", "Whoami", nil, CodeOK},
+		{"", "Store", []interface{}{"x"}, CodeUnauthenticated},
+		{"alice", "Store", []interface{}{"x"}, CodePermissionDenied},
+		{"root", "Store", []interface{}{"x"}, CodeOK},
+		{"forged", "Whoami", nil, CodeUnauthenticated},
+		//the code wrapped by the error of the Authenticator is sent
+		{"banned", "Whoami", nil, CodePermissionDenied},
+	}
+	for _, tt := range tests {
+		c := conn
+		if tt.token == "" {
+			c = anonymous
+		}
+		_, err := InvokeContext[any](withToken(tt.token), c, "Auth", tt.method, tt.args...)
+		if got := ErrorCode(err); got != tt.want {
+			t.Errorf("token %q calling %s: got %v, want %v", tt.token, tt.method, err, tt.want)
+		}
+	}
+	//the rejections do not break the connection
+	if got, err := InvokeContext[string](withToken("alice"), conn, "Auth", "Whoami"); err != nil || got != "alice" {
+		t.Fatalf("Whoami = %q, %v", got, err)
+	}
+}
+
+func TestAuthRejectedArgsNotRead(t *testing.T) {
+	impl, addr := startAuthServer(t)
+	conn := dialAuth(t, addr, false)
+	//a large argument is discarded, and the connection serves the next call
+	_, err := Invoke[any](conn, "Auth", "Store", strings.Repeat("x", 1<<20))
+	if ErrorCode(err) != CodeUnauthenticated {
+		t.Fatalf("got %v, want unauthenticated", err)
+	}
+	//an ostream argument carries no data, the connection is kept too
+	var buf bytes.Buffer
+	if _, err := Invoke[any](conn, "Auth", "Download", OStream(&buf)); ErrorCode(err) != CodeUnauthenticated {
+		t.Fatalf("got %v, want unauthenticated", err)
+	}
+	if got, err := Invoke[string](conn, "Auth", "Whoami"); err != nil || got != "anonymous" {
+		t.Fatalf("Whoami = %q, %v", got, err)
+	}
+	//the istream argument is not read, the connection is closed instead
+	r := &countingReader{n: 1 << 30}
+	if _, err := Invoke[int32](conn, "Auth", "Upload", IStream(r)); err == nil {
+		t.Fatal("the upload without a token succeeded")
+	}
+	if read := atomic.LoadInt64(&r.read); read >= r.n {
+		t.Fatalf("the server read the whole stream of %d bytes", read)
+	}
+	if n := atomic.LoadInt32(&impl.called); n != 1 {
+		t.Fatalf("handlers called %d times, want only by Whoami", n)
+	}
+}
+
+// countingReader reads n zero bytes, and counts the bytes read.
+type countingReader struct {
+	n    int64
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	left := r.n - atomic.LoadInt64(&r.read)
+	if left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > left {
+		p = p[:left]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	atomic.AddInt64(&r.read, int64(len(p)))
+	return len(p), nil
+}
@@ -0,0 +1,540 @@
+package rpch
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Address is a server address of Balancer. Weight is used by the Weighted
+// policy, and is 1 if it is not positive.
+type Address struct {
+	Addr   string
+	Weight int
+}
+
+// Addresses makes the Addresses of weight 1.
+func Addresses(addrs ...string) []Address {
+	res := make([]Address, len(addrs))
+	for i, addr := range addrs {
+		res[i] = Address{Addr: addr, Weight: 1}
+	}
+	return res
+}
+
+// Endpoint is a server of Balancer seen by policies.
+type Endpoint struct {
+	addr        string
+	weight      int64
+	outstanding int64
+	//consecutive failures, which decide the eject time
+	failures int32
+	//conn is nil when the endpoint is connecting or ejected, it is guarded
+	//by Balancer.lock as well as removed
+	conn    *Conn
+	removed bool
+}
+
+func (ep *Endpoint) Addr() string {
+	return ep.addr
+}
+
+func (ep *Endpoint) Weight() int {
+	return int(atomic.LoadInt64(&ep.weight))
+}
+
+// Outstanding returns the number of calls in flight on the endpoint, including
+// the stream responses not closed yet.
+func (ep *Endpoint) Outstanding() int64 {
+	return atomic.LoadInt64(&ep.outstanding)
+}
+
+// PickInfo describes the call to be routed.
+type PickInfo struct {
+	Ctx     context.Context
+	Service string
+	Method  string
+	Args    []*RequestArg
+}
+
+// Policy picks the endpoint for each call. The endpoints are the connected ones
+// sorted by address, and are never empty. Returning nil fails the call with
+// CodeUnavailable. Pick is called with the lock of Balancer held, so it should
+// be fast.
+type Policy interface {
+	Pick(info *PickInfo, endpoints []*Endpoint) *Endpoint
+}
+
+type roundRobin struct {
+	next uint64
+}
+
+// RoundRobin picks the endpoints in turn.
+func RoundRobin() Policy {
+	return new(roundRobin)
+}
+
+func (rr *roundRobin) Pick(info *PickInfo, endpoints []*Endpoint) *Endpoint {
+	n := atomic.AddUint64(&rr.next, 1)
+	return endpoints[n%uint64(len(endpoints))]
+}
+
+type leastOutstanding struct {
+	next uint64
+}
+
+// LeastOutstanding picks the endpoint with the fewest calls in flight, the ties
+// are broken in turn.
+func LeastOutstanding() Policy {
+	return new(leastOutstanding)
+}
+
+func (lo *leastOutstanding) Pick(info *PickInfo, endpoints []*Endpoint) *Endpoint {
+	start := int(atomic.AddUint64(&lo.next, 1) % uint64(len(endpoints)))
+	var best *Endpoint
+	for i := range endpoints {
+		ep := endpoints[(start+i)%len(endpoints)]
+		if best == nil || ep.Outstanding() < best.Outstanding() {
+			best = ep
+		}
+	}
+	return best
+}
+
+type p2c struct {
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// PowerOfTwoChoices picks two endpoints at random, and then the one with fewer
+// calls in flight.
+func PowerOfTwoChoices() Policy {
+	return &p2c{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (p *p2c) Pick(info *PickInfo, endpoints []*Endpoint) *Endpoint {
+	if len(endpoints) == 1 {
+		return endpoints[0]
+	}
+	p.lock.Lock()
+	i := p.rand.Intn(len(endpoints))
+	j := p.rand.Intn(len(endpoints) - 1)
+	p.lock.Unlock()
+	if j >= i {
+		j++
+	}
+	a, b := endpoints[i], endpoints[j]
+	if b.Outstanding() < a.Outstanding() {
+		return b
+	}
+	return a
+}
+
+type weighted struct {
+	lock    sync.Mutex
+	current map[*Endpoint]int
+}
+
+// Weighted picks the endpoints in proportion to their weights by smooth
+// weighted round-robin, which spreads the picks of an endpoint evenly.
+func Weighted() Policy {
+	return &weighted{current: make(map[*Endpoint]int)}
+}
+
+func (w *weighted) Pick(info *PickInfo, endpoints []*Endpoint) *Endpoint {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	//forget the endpoints gone
+	if len(w.current) > 2*len(endpoints) {
+		current := make(map[*Endpoint]int, len(endpoints))
+		for _, ep := range endpoints {
+			current[ep] = w.current[ep]
+		}
+		w.current = current
+	}
+	var best *Endpoint
+	var total int
+	for _, ep := range endpoints {
+		weight := ep.Weight()
+		total += weight
+		w.current[ep] += weight
+		if best == nil || w.current[ep] > w.current[best] {
+			best = ep
+		}
+	}
+	w.current[best] -= total
+	return best
+}
+
+// BalancerOption configures the Balancer made by NewBalancer.
+type BalancerOption func(*Balancer)
+
+// WithPolicy sets the policy of Balancer, which is RoundRobin by default.
+func WithPolicy(p Policy) BalancerOption {
+	return func(b *Balancer) {
+		b.policy = p
+	}
+}
+
+// WithDialOptions sets the options used to dial the endpoints.
+func WithDialOptions(opts ...DialOption) BalancerOption {
+	return func(b *Balancer) {
+		b.dialOpts = append(b.dialOpts, opts...)
+	}
+}
+
+// WithBalancerLogger sets the logger of the Balancer's own events such as
+// ejections, which is DefaultLogger by default. The connections to endpoints
+// log by the logger given by WithDialOptions(WithLogger(l)).
+func WithBalancerLogger(l Logger) BalancerOption {
+	return func(b *Balancer) {
+		b.logger = l
+	}
+}
+
+// WithEjectTime sets how long an endpoint is ejected after it fails. The time
+// doubles on consecutive failures up to max. The defaults are 1s and 30s.
+func WithEjectTime(base, max time.Duration) BalancerOption {
+	return func(b *Balancer) {
+		b.ejectTime = base
+		b.maxEjectTime = max
+	}
+}
+
+// WithCircuitBreaker gives each endpoint a circuit breaker, or one for each
+// method of the endpoint if config.PerMethod is set. The endpoints whose
+// breakers are open are not picked, and calls fail with CodeCircuitOpen if all
+// breakers are open.
+func WithCircuitBreaker(config BreakerConfig) BalancerOption {
+	return func(b *Balancer) {
+		b.breakers = newBreakerSet(config)
+	}
+}
+
+// Balancer holds connections to a set of endpoints, and picks one by its policy
+// for each call. An endpoint failing to connect or breaking the connection is
+// ejected, and then dialed again after the eject time.
+//
+// Balancer implements Caller, so it can be used by Invoke, NewClient and
+// DynamicClient in place of Conn.
+type Balancer struct {
+	policy       Policy
+	dialOpts     []DialOption
+	ejectTime    time.Duration
+	maxEjectTime time.Duration
+	logger       Logger
+	breakers     *breakerSet
+	lock         sync.Mutex
+	endpoints    map[string]*Endpoint
+	//the connected endpoints sorted by address
+	ready    []*Endpoint
+	closed   bool
+	done     chan struct{}
+	resolver Resolver
+}
+
+// NewBalancer dials addrs and returns a Balancer after every address is tried.
+// Addresses failing to connect are retried in background.
+func NewBalancer(addrs []Address, opts ...BalancerOption) *Balancer {
+	b := newBalancer(opts)
+	var wg sync.WaitGroup
+	b.update(addrs, &wg)
+	wg.Wait()
+	return b
+}
+
+func newBalancer(opts []BalancerOption) *Balancer {
+	b := &Balancer{
+		policy:       RoundRobin(),
+		ejectTime:    time.Second,
+		maxEjectTime: 30 * time.Second,
+		endpoints:    make(map[string]*Endpoint),
+		done:         make(chan struct{}),
+		logger:       DefaultLogger,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.logger == nil {
+		b.logger = DefaultLogger
+	}
+	return b
+}
+
+// UpdateAddresses replaces the endpoints with addrs. New addresses are dialed in
+// background, and the connections of removed ones are closed after their calls
+// return and their stream responses are closed.
+func (b *Balancer) UpdateAddresses(addrs []Address) {
+	b.update(addrs, nil)
+}
+
+func (b *Balancer) update(addrs []Address, wg *sync.WaitGroup) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return
+	}
+	seen := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		seen[addr.Addr] = true
+		weight := int64(addr.Weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		if ep, ok := b.endpoints[addr.Addr]; ok {
+			atomic.StoreInt64(&ep.weight, weight)
+			continue
+		}
+		ep := &Endpoint{addr: addr.Addr, weight: weight}
+		b.endpoints[addr.Addr] = ep
+		if wg != nil {
+			wg.Add(1)
+		}
+		go func() {
+			b.connect(ep, 0, wg)
+		}()
+	}
+	for addr, ep := range b.endpoints {
+		if seen[addr] {
+			continue
+		}
+		ep.removed = true
+		delete(b.endpoints, addr)
+		if b.breakers != nil {
+			b.breakers.remove(addr)
+		}
+		if ep.conn != nil && ep.Outstanding() == 0 {
+			ep.conn.Close()
+			ep.conn = nil
+		}
+	}
+	b.rebuild()
+}
+
+// rebuild updates the ready endpoints, the lock should be held.
+func (b *Balancer) rebuild() {
+	ready := make([]*Endpoint, 0, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		if ep.conn != nil {
+			ready = append(ready, ep)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].addr < ready[j].addr
+	})
+	b.ready = ready
+}
+
+func (b *Balancer) ejectDelay(failures int32) time.Duration {
+	delay := b.ejectTime
+	for i := int32(1); i < failures && delay < b.maxEjectTime; i++ {
+		delay *= 2
+	}
+	if delay > b.maxEjectTime {
+		delay = b.maxEjectTime
+	}
+	return delay
+}
+
+// connect dials ep after delay until it succeeds or ep is removed. wg is done
+// after the first try.
+func (b *Balancer) connect(ep *Endpoint, delay time.Duration, wg *sync.WaitGroup) {
+	for {
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-b.done:
+				return
+			}
+		}
+		conn, err := Dial(ep.addr, b.dialOpts...)
+		if wg != nil {
+			wg.Done()
+			wg = nil
+		}
+		b.lock.Lock()
+		if b.closed || ep.removed {
+			b.lock.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err == nil {
+			ep.conn = conn
+			b.rebuild()
+			b.lock.Unlock()
+			return
+		}
+		b.lock.Unlock()
+		failures := atomic.AddInt32(&ep.failures, 1)
+		delay = b.ejectDelay(failures)
+		b.logger.Log(LevelWarn, "endpoint failed to connect", F(FieldRemoteAddr, ep.addr), F(FieldError, err), F("retry_in", delay))
+	}
+}
+
+// eject removes ep from the ready endpoints if conn is still its connection.
+func (b *Balancer) eject(ep *Endpoint, conn *Conn, err error) {
+	b.lock.Lock()
+	if b.closed || ep.removed || ep.conn != conn {
+		b.lock.Unlock()
+		return
+	}
+	ep.conn = nil
+	b.rebuild()
+	b.lock.Unlock()
+	conn.Close()
+	failures := atomic.AddInt32(&ep.failures, 1)
+	delay := b.ejectDelay(failures)
+	b.logger.Log(LevelWarn, "endpoint ejected", F(FieldRemoteAddr, ep.addr), F(FieldError, err), F("retry_in", delay))
+	go b.connect(ep, delay, nil)
+}
+
+func (b *Balancer) pick(info *PickInfo) (*Endpoint, *Conn, *breaker, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil, nil, nil, errClientClosed
+	}
+	if len(b.ready) == 0 {
+		return nil, nil, nil, Errorf(CodeUnavailable, "rpch: no available endpoint for %s.%s", info.Service, info.Method)
+	}
+	candidates := b.ready
+	hedge := hedgeCopyFromContext(info.Ctx)
+	if b.breakers != nil || hedge != nil {
+		candidates = nil
+		open := false
+		for _, ep := range b.ready {
+			//the copies of a hedged call go to different endpoints
+			if hedge != nil && hedge.set.contains(ep) {
+				continue
+			}
+			if b.breakers != nil && !b.breakers.get(ep.addr, info.Service, info.Method).available() {
+				open = true
+				continue
+			}
+			candidates = append(candidates, ep)
+		}
+		if len(candidates) == 0 {
+			if open {
+				return nil, nil, nil, Errorf(CodeCircuitOpen, "rpch: circuit breakers of all endpoints are open for %s.%s", info.Service, info.Method)
+			}
+			return nil, nil, nil, Errorf(CodeUnavailable, "rpch: no other endpoint for hedging %s.%s", info.Service, info.Method)
+		}
+	}
+	ep := b.policy.Pick(info, candidates)
+	if ep == nil {
+		return nil, nil, nil, Errorf(CodeUnavailable, "rpch: no endpoint picked for %s.%s", info.Service, info.Method)
+	}
+	var br *breaker
+	if b.breakers != nil {
+		//the half-open breaker may be taken by other calls since available
+		if br = b.breakers.get(ep.addr, info.Service, info.Method); !br.allow() {
+			return nil, nil, nil, errCircuitOpen(br.name)
+		}
+	}
+	if hedge != nil {
+		hedge.pick(ep)
+	}
+	atomic.AddInt64(&ep.outstanding, 1)
+	return ep, ep.conn, br, nil
+}
+
+func (b *Balancer) release(ep *Endpoint) {
+	if atomic.AddInt64(&ep.outstanding, -1) != 0 {
+		return
+	}
+	b.lock.Lock()
+	if ep.removed && ep.conn != nil && ep.Outstanding() == 0 {
+		ep.conn.Close()
+		ep.conn = nil
+	}
+	b.lock.Unlock()
+}
+
+func (b *Balancer) Call(service, method string, args ...*RequestArg) (interface{}, error) {
+	return b.CallContext(context.Background(), service, method, args...)
+}
+
+// CallContext calls on the endpoint picked by the policy, see Conn.CallContext.
+func (b *Balancer) CallContext(ctx context.Context, service, method string, args ...*RequestArg) (interface{}, error) {
+	ep, conn, br, err := b.pick(&PickInfo{Ctx: ctx, Service: service, Method: method, Args: args})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conn.CallContext(ctx, service, method, args...)
+	if br != nil {
+		br.done(err)
+	}
+	if conn.broken(err) {
+		b.eject(ep, conn, err)
+	} else if atomic.LoadInt32(&ep.failures) != 0 {
+		atomic.StoreInt32(&ep.failures, 0)
+	}
+	//a stream response still uses the connection until it is closed
+	return releaseOnClose(resp, func() { b.release(ep) }), err
+}
+
+// releaseOnClose calls release once the stream resp is closed, or at once if
+// resp is not a stream.
+func releaseOnClose(resp interface{}, release func()) interface{} {
+	switch stream := resp.(type) {
+	case io.ReadWriteCloser:
+		return &releaseReadWriteCloser{ReadWriteCloser: stream, release: release}
+	case io.WriteCloser:
+		return &releaseWriteCloser{WriteCloser: stream, release: release}
+	}
+	release()
+	return resp
+}
+
+type releaseReadWriteCloser struct {
+	io.ReadWriteCloser
+	once    sync.Once
+	release func()
+}
+
+func (rc *releaseReadWriteCloser) Close() error {
+	err := rc.ReadWriteCloser.Close()
+	rc.once.Do(rc.release)
+	return err
+}
+
+type releaseWriteCloser struct {
+	io.WriteCloser
+	once    sync.Once
+	release func()
+}
+
+func (wc *releaseWriteCloser) Close() error {
+	err := wc.WriteCloser.Close()
+	wc.once.Do(wc.release)
+	return err
+}
+
+// Close closes the connections to all endpoints, and the resolver if the
+// Balancer is made by DialBalancer.
+func (b *Balancer) Close() error {
+	if b.resolver != nil {
+		b.resolver.Close()
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	for _, ep := range b.endpoints {
+		if ep.conn != nil {
+			ep.conn.Close()
+			ep.conn = nil
+		}
+	}
+	b.ready = nil
+	return nil
+}
@@ -0,0 +1,279 @@
+package rpch
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BreakerState int32
+
+const (
+	// BreakerClosed lets all calls pass.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails all calls with CodeCircuitOpen until the cool-down ends.
+	BreakerOpen
+	// BreakerHalfOpen lets a few calls pass to probe whether the downstream
+	// recovers.
+	BreakerHalfOpen
+)
+
+var breakerStateNames = [...]string{"closed", "open", "half_open"}
+
+func (s BreakerState) String() string {
+	if s < 0 || int(s) >= len(breakerStateNames) {
+		return "unknown"
+	}
+	return breakerStateNames[s]
+}
+
+// BreakerConfig configures the circuit breakers of BreakerCaller or Balancer.
+// The zero values of fields take the defaults.
+type BreakerConfig struct {
+	// FailureRate opens the breaker when the rate of failures reaches it in a
+	// Window with at least MinRequests calls, 0 disables it.
+	FailureRate float64
+	// Window is the period in which the failure rate is counted, 10s by default.
+	Window time.Duration
+	// MinRequests defaults to 10.
+	MinRequests int
+	// ConsecutiveFailures opens the breaker when so many calls fail in a row.
+	// It is 5 by default if FailureRate is 0, otherwise 0 disables it.
+	ConsecutiveFailures int
+	// CoolDown is how long the breaker stays open before half-open, 5s by
+	// default.
+	CoolDown time.Duration
+	// HalfOpenCalls is the number of calls let through when half-open, all of
+	// which should succeed to close the breaker. It is 1 by default.
+	HalfOpenCalls int
+	// PerMethod makes a breaker for each method instead of one for all.
+	PerMethod bool
+	// IsFailure reports whether the error of a call is a failure. By default
+	// the errors breaking the connection and the codes unavailable and internal
+	// are failures. The calls canceled by the caller are not counted.
+	IsFailure func(err error) bool
+	// OnStateChange is called when a breaker changes state. Name is the
+	// endpoint address for Balancer and empty for BreakerCaller, followed by
+	// "/Service.Method" if PerMethod is set.
+	OnStateChange func(name string, from, to BreakerState)
+}
+
+func (c *BreakerConfig) isFailure(err error) bool {
+	if c.IsFailure != nil {
+		return c.IsFailure(err)
+	}
+	if err == nil {
+		return false
+	}
+	if !IsNonSeriousError(err) {
+		return true
+	}
+	switch ErrorCode(err) {
+	case CodeUnavailable, CodeInternal:
+		return true
+	}
+	return false
+}
+
+type breaker struct {
+	config *BreakerConfig
+	name   string
+	lock   sync.Mutex
+	state  BreakerState
+	//counters of the closed state
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+	//when the breaker opened
+	openedAt time.Time
+	//calls let through and succeeded in the half-open state
+	probes    int
+	successes int
+}
+
+// transition changes the state, the lock should be held. The returned function
+// calls OnStateChange, which should be called after unlocking.
+func (b *breaker) transition(to BreakerState, now time.Time) func() {
+	from := b.state
+	b.state = to
+	switch to {
+	case BreakerClosed:
+		b.windowStart, b.requests, b.failures, b.consecutive = now, 0, 0, 0
+	case BreakerOpen:
+		b.openedAt = now
+	case BreakerHalfOpen:
+		b.probes, b.successes = 0, 0
+	}
+	if f := b.config.OnStateChange; f != nil {
+		return func() { f(b.name, from, to) }
+	}
+	return func() {}
+}
+
+// available reports whether allow may return true, without taking a slot of
+// the half-open state.
+func (b *breaker) available() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.openedAt) >= b.config.CoolDown
+	case BreakerHalfOpen:
+		return b.probes < b.config.HalfOpenCalls
+	}
+	return true
+}
+
+// allow reports whether a call can pass, the passed call should report its
+// result by done.
+func (b *breaker) allow() bool {
+	notify := func() {}
+	defer func() { notify() }()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == BreakerOpen {
+		now := time.Now()
+		if now.Sub(b.openedAt) < b.config.CoolDown {
+			return false
+		}
+		notify = b.transition(BreakerHalfOpen, now)
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.config.HalfOpenCalls {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+func (b *breaker) done(err error) {
+	if errors.Is(err, context.Canceled) {
+		//the canceled call tells nothing about the downstream, give its
+		//half-open slot back
+		b.lock.Lock()
+		if b.state == BreakerHalfOpen && b.probes > 0 {
+			b.probes--
+		}
+		b.lock.Unlock()
+		return
+	}
+	failed := b.config.isFailure(err)
+	notify := func() {}
+	defer func() { notify() }()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			notify = b.transition(BreakerOpen, now)
+		} else if b.successes++; b.successes >= b.config.HalfOpenCalls {
+			notify = b.transition(BreakerClosed, now)
+		}
+	case BreakerClosed:
+		if now.Sub(b.windowStart) >= b.config.Window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		b.requests++
+		if !failed {
+			b.consecutive = 0
+			return
+		}
+		b.failures++
+		b.consecutive++
+		c := b.config
+		if c.ConsecutiveFailures > 0 && b.consecutive >= c.ConsecutiveFailures ||
+			c.FailureRate > 0 && b.requests >= c.MinRequests && float64(b.failures) >= c.FailureRate*float64(b.requests) {
+			notify = b.transition(BreakerOpen, now)
+		}
+	}
+	//the results of calls let through before opening are ignored
+}
+
+type breakerSet struct {
+	config   BreakerConfig
+	lock     sync.Mutex
+	breakers map[string]*breaker
+}
+
+func newBreakerSet(config BreakerConfig) *breakerSet {
+	if config.Window <= 0 {
+		config.Window = 10 * time.Second
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = 10
+	}
+	if config.ConsecutiveFailures <= 0 && config.FailureRate <= 0 {
+		config.ConsecutiveFailures = 5
+	}
+	if config.CoolDown <= 0 {
+		config.CoolDown = 5 * time.Second
+	}
+	if config.HalfOpenCalls <= 0 {
+		config.HalfOpenCalls = 1
+	}
+	return &breakerSet{config: config, breakers: make(map[string]*breaker)}
+}
+
+func (bs *breakerSet) get(name, service, method string) *breaker {
+	if bs.config.PerMethod {
+		name += "/" + service + "." + method
+	}
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	b, ok := bs.breakers[name]
+	if !ok {
+		b = &breaker{config: &bs.config, name: name, windowStart: time.Now()}
+		bs.breakers[name] = b
+	}
+	return b
+}
+
+// remove drops the breakers of the endpoint name, including the ones of its
+// methods.
+func (bs *breakerSet) remove(name string) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	for key := range bs.breakers {
+		if key == name || strings.HasPrefix(key, name+"/") {
+			delete(bs.breakers, key)
+		}
+	}
+}
+
+func errCircuitOpen(name string) error {
+	if name == "" {
+		return NewError(CodeCircuitOpen, "rpch: circuit breaker is open")
+	}
+	return Errorf(CodeCircuitOpen, "rpch: circuit breaker %s is open", name)
+}
+
+// BreakerCaller fails calls fast with CodeCircuitOpen when the Caller it wraps
+// keeps failing. To break the circuits of endpoints separately, use
+// WithCircuitBreaker of Balancer instead.
+type BreakerCaller struct {
+	caller   Caller
+	breakers *breakerSet
+}
+
+func NewBreakerCaller(caller Caller, config BreakerConfig) *BreakerCaller {
+	return &BreakerCaller{caller: caller, breakers: newBreakerSet(config)}
+}
+
+func (bc *BreakerCaller) Call(service, method string, args ...*RequestArg) (interface{}, error) {
+	return bc.CallContext(context.Background(), service, method, args...)
+}
+
+func (bc *BreakerCaller) CallContext(ctx context.Context, service, method string, args ...*RequestArg) (interface{}, error) {
+	b := bc.breakers.get("", service, method)
+	if !b.allow() {
+		return nil, errCircuitOpen(b.name)
+	}
+	resp, err := bc.caller.CallContext(ctx, service, method, args...)
+	b.done(err)
+	return resp, err
+}
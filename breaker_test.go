@@ -0,0 +1,177 @@
+package rpch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// callerFunc is a Caller answering calls by the function.
+type callerFunc func(ctx context.Context, service, method string, args ...*RequestArg) (interface{}, error)
+
+func (f callerFunc) Call(service, method string, args ...*RequestArg) (interface{}, error) {
+	return f(context.Background(), service, method, args...)
+}
+
+func (f callerFunc) CallContext(ctx context.Context, service, method string, args ...*RequestArg) (interface{}, error) {
+	return f(ctx, service, method, args...)
+}
+
+// switchCaller fails calls with err until it is set to nil, and counts calls.
+type switchCaller struct {
+	lock  sync.Mutex
+	err   error
+	calls int
+}
+
+func (s *switchCaller) set(err error) {
+	s.lock.Lock()
+	s.err = err
+	s.lock.Unlock()
+}
+
+func (s *switchCaller) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls
+}
+
+func (s *switchCaller) caller() Caller {
+	return callerFunc(func(ctx context.Context, service, method string, args ...*RequestArg) (interface{}, error) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.calls++
+		return "ok", s.err
+	})
+}
+
+func TestBreakerOpensAndRecovers(t *testing.T) {
+	sc := &switchCaller{err: NewError(CodeUnavailable, "down")}
+	var lock sync.Mutex
+	var changes []string
+	bc := NewBreakerCaller(sc.caller(), BreakerConfig{
+		ConsecutiveFailures: 3,
+		CoolDown:            50 * time.Millisecond,
+		OnStateChange: func(name string, from, to BreakerState) {
+			lock.Lock()
+			changes = append(changes, from.String()+"->"+to.String())
+			lock.Unlock()
+		},
+	})
+	for i := 0; i < 3; i++ {
+		if _, err := bc.Call("S", "M"); ErrorCode(err) != CodeUnavailable {
+			t.Fatalf("call %d: got %v, want unavailable", i, err)
+		}
+	}
+	//open: fail fast without calling
+	if _, err := bc.Call("S", "M"); ErrorCode(err) != CodeCircuitOpen {
+		t.Fatalf("got %v, want circuit open", err)
+	}
+	if sc.count() != 3 {
+		t.Fatalf("open breaker let %d calls through, want 3", sc.count())
+	}
+	//a failed probe opens the breaker again
+	time.Sleep(60 * time.Millisecond)
+	if _, err := bc.Call("S", "M"); ErrorCode(err) != CodeUnavailable {
+		t.Fatalf("probe: got %v, want unavailable", err)
+	}
+	if _, err := bc.Call("S", "M"); ErrorCode(err) != CodeCircuitOpen {
+		t.Fatalf("got %v, want circuit open after a failed probe", err)
+	}
+	//a successful probe closes it
+	sc.set(nil)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		if _, err := bc.Call("S", "M"); err != nil {
+			t.Fatalf("call %d after recovery: %v", i, err)
+		}
+	}
+	want := []string{"closed->open", "open->half_open", "half_open->open", "open->half_open", "half_open->closed"}
+	lock.Lock()
+	defer lock.Unlock()
+	if fmt.Sprint(changes) != fmt.Sprint(want) {
+		t.Fatalf("state changes %v, want %v", changes, want)
+	}
+}
+
+func TestBreakerHalfOpenLetsLimitedProbes(t *testing.T) {
+	b := newBreakerSet(BreakerConfig{ConsecutiveFailures: 1, CoolDown: time.Millisecond, HalfOpenCalls: 2}).get("", "S", "M")
+	if !b.allow() {
+		t.Fatal("closed breaker rejects a call")
+	}
+	b.done(NewError(CodeInternal, "boom"))
+	time.Sleep(5 * time.Millisecond)
+	if !b.allow() || !b.allow() {
+		t.Fatal("half-open breaker rejects the probes")
+	}
+	if b.allow() {
+		t.Fatal("half-open breaker lets more than HalfOpenCalls probes through")
+	}
+	//all the probes should succeed to close the breaker
+	b.done(nil)
+	if b.state != BreakerHalfOpen {
+		t.Fatalf("state %v after one of two probes succeeded, want half_open", b.state)
+	}
+	b.done(nil)
+	if b.state != BreakerClosed {
+		t.Fatalf("state %v after the probes succeeded, want closed", b.state)
+	}
+}
+
+func TestBreakerFailureRate(t *testing.T) {
+	b := newBreakerSet(BreakerConfig{FailureRate: 0.5, MinRequests: 4}).get("", "S", "M")
+	//below MinRequests a high rate does not open the breaker
+	b.done(NewError(CodeUnavailable, "down"))
+	b.done(NewError(CodeUnavailable, "down"))
+	b.done(nil)
+	if b.state != BreakerClosed {
+		t.Fatalf("state %v with 3 requests, want closed", b.state)
+	}
+	b.done(NewError(CodeUnavailable, "down"))
+	if b.state != BreakerOpen {
+		t.Fatalf("state %v with 3 of 4 requests failed, want open", b.state)
+	}
+
+	b = newBreakerSet(BreakerConfig{FailureRate: 0.5, MinRequests: 4}).get("", "S", "M")
+	for i := 0; i < 3; i++ {
+		b.done(nil)
+	}
+	b.done(NewError(CodeUnavailable, "down"))
+	if b.state != BreakerClosed {
+		t.Fatalf("state %v with 1 of 4 requests failed, want closed", b.state)
+	}
+}
+
+func TestBreakerIsFailure(t *testing.T) {
+	var c BreakerConfig
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{NewError(CodeInvalidArgument, "bad"), false},
+		{NewError(CodeUnavailable, "down"), true},
+		{fmt.Errorf("wrapped: %w", NewError(CodeUnimplemented, "no method")), false},
+		{fmt.Errorf("wrapped: %w", NewError(CodeInternal, "boom")), true},
+		{errors.New("connection reset"), true},
+	}
+	for _, tt := range tests {
+		if got := c.isFailure(tt.err); got != tt.want {
+			t.Errorf("isFailure(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBreakerSetRemove(t *testing.T) {
+	bs := newBreakerSet(BreakerConfig{PerMethod: true})
+	bs.get("a:1", "S", "M")
+	bs.get("a:1", "S", "N")
+	bs.get("a:10", "S", "M")
+	bs.remove("a:1")
+	if len(bs.breakers) != 1 || bs.breakers["a:10/S.M"] == nil {
+		t.Fatalf("breakers %v after removing a:1, want only a:10/S.M", bs.breakers)
+	}
+}
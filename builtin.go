@@ -145,8 +145,14 @@ var builtinUnmarshal = map[string]func([]byte) (*reflect.Value, error){
 	"float32": float32Unmarshal, "float64": float64Unmarshal, "string": stringUnmarshal, "bool": boolUnmarshal,
 }
 
+var builtinTypes = map[string]reflect.Type{
+	"int8": reflect.TypeOf(int8(0)), "int16": reflect.TypeOf(int16(0)), "int32": reflect.TypeOf(int32(0)), "int64": reflect.TypeOf(int64(0)),
+	"uint8": reflect.TypeOf(uint8(0)), "uint16": reflect.TypeOf(uint16(0)), "uint32": reflect.TypeOf(uint32(0)), "uint64": reflect.TypeOf(uint64(0)),
+	"float32": reflect.TypeOf(float32(0)), "float64": reflect.TypeOf(float64(0)), "string": reflect.TypeOf(""), "bool": reflect.TypeOf(false),
+}
+
 func genErr(expectLen int, _type string) error {
-	return newProtoError(fmt.Sprintf("rpch: expect argument type: %s which expected to be %d bytes", _type, expectLen))
+	return Errorf(CodeInvalidArgument, "rpch: expect argument type: %s which expected to be %d bytes", _type, expectLen)
 }
 
 func newType(expectedLen int, name string, buf []byte, call func(buf []byte) *reflect.Value) (*reflect.Value, error) {
@@ -252,14 +258,19 @@ func IsBuiltinType(t string) bool {
 	return ok
 }
 
+// IsStreamType reports whether t is stream, istream or ostream.
+func IsStreamType(t string) bool {
+	return t == "stream" || t == "istream" || t == "ostream"
+}
+
 func GetTypeKind(t string) uint16 {
 	var tk uint16
 	if IsBuiltinType(t) {
-		tk = 0
-	} else if t == "stream" || t == "istream" || t == "ostream" {
-		tk = 1
+		tk = typeKind_Normal
+	} else if IsStreamType(t) {
+		tk = typeKind_Stream
 	} else {
-		tk = 2
+		tk = typeKind_Message
 	}
 	return tk
 }
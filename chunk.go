@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync/atomic"
 )
 
 type chunkReader struct {
@@ -14,9 +15,19 @@ type chunkReader struct {
 	//利用done来记录报文主体是否读取完毕
 	done bool
 	crlf [2]byte //用来读取\r\n
+	//统计读取的字节数，可以为nil
+	count *int64
 }
 
 func (cw *chunkReader) Read(p []byte) (n int, err error) {
+	n, err = cw.read(p)
+	if cw.count != nil && n > 0 {
+		atomic.AddInt64(cw.count, int64(n))
+	}
+	return
+}
+
+func (cw *chunkReader) read(p []byte) (n int, err error) {
 	if cw.done {
 		return 0, io.EOF
 	}
@@ -36,6 +47,10 @@ func (cw *chunkReader) Read(p []byte) (n int, err error) {
 	if len(p) <= cw.n {
 		n, err = cw.bufr.Read(p)
 		cw.n -= n
+		//the chunk ends exactly at the end of p
+		if err == nil && cw.n == 0 {
+			err = cw.discardCRLF()
+		}
 		return n, err
 	}
 	//如果当前块剩余的数据不够p的长度
@@ -96,6 +111,8 @@ func readLine(bufr *bufio.Reader) ([]byte, error) {
 
 type chunkWriter struct {
 	w io.Writer
+	//统计写入的字节数，可以为nil
+	count *int64
 }
 
 func (cw *chunkWriter) Write(p []byte) (int, error) {
@@ -107,5 +124,8 @@ func (cw *chunkWriter) Write(p []byte) (int, error) {
 	if err == nil {
 		_, err = cw.w.Write([]byte("\r\n"))
 	}
+	if cw.count != nil && n > 0 {
+		atomic.AddInt64(cw.count, int64(n))
+	}
 	return n, err
 }
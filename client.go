@@ -1,47 +1,158 @@
 package rpch
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"reflect"
 	"sync"
+	"time"
 )
 
 const respHeadLen = 16
 
+// Caller is the call surface shared by Conn and Balancer. Invoke, NewClient and
+// DynamicClient make calls through it.
+type Caller interface {
+	Call(service, method string, args ...*RequestArg) (resp interface{}, err error)
+	CallContext(ctx context.Context, service, method string, args ...*RequestArg) (resp interface{}, err error)
+}
+
 type Conn struct {
-	conn        *conn
-	seq         uint64
-	seqLock     sync.Mutex
-	closeOnce   sync.Once
-	closed      bool
-	respHeadBuf []byte
-	readyCh     chan bool
+	conn      *conn
+	seq       uint64
+	seqLock   sync.Mutex
+	closeOnce sync.Once
+	closed    bool
+	readyCh   chan bool
+	metrics   *Metrics
+	tracer    *Tracer
+	logger    Logger
+	tokens    TokenSource
+	multiplex bool
+	//mux is not nil if the connection is multiplexed, then each call has its
+	//own stream and readyCh is not used
+	mux *muxSession
+}
+
+// DialOption configures the Conn made by Dial.
+type DialOption func(*Conn)
+
+// WithMetrics makes the Conn report its telemetry to m.
+func WithMetrics(m *Metrics) DialOption {
+	return func(client *Conn) {
+		client.metrics = m
+	}
+}
+
+// WithTracer makes the Conn start a span for each call and propagate the trace
+// context to the server.
+func WithTracer(t *Tracer) DialOption {
+	return func(client *Conn) {
+		client.tracer = t
+	}
 }
 
-func Dial(addr string) (*Conn, error) {
+// WithLogger makes the Conn log to l instead of DefaultLogger.
+func WithLogger(l Logger) DialOption {
+	return func(client *Conn) {
+		client.logger = l
+	}
+}
+
+// WithMultiplexing makes the Conn multiplex its calls on the connection, so
+// that concurrent calls and open stream responses do not wait for each other.
+// If the server does not support multiplexing, the Conn falls back to serving
+// one call at a time.
+func WithMultiplexing() DialOption {
+	return func(client *Conn) {
+		client.multiplex = true
+	}
+}
+
+func Dial(addr string, opts ...DialOption) (*Conn, error) {
+	cli := &Conn{
+		readyCh: make(chan bool, 1),
+		logger:  DefaultLogger,
+	}
+	for _, opt := range opts {
+		opt(cli)
+	}
+	if cli.logger == nil {
+		cli.logger = DefaultLogger
+	}
 	rwc, err := net.Dial("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
+	if cli.multiplex {
+		if handshakeMux(rwc) {
+			cli.conn = newConn(nil, rwc, cli.logger)
+			cli.mux = newMuxSession(cli.conn.rwc, cli.conn.bufr, nil)
+			go cli.mux.serve()
+			cli.metrics.addActiveConns(sideClient, 1)
+			return cli, nil
+		}
+		//the server closes the connection on the unknown magic
+		rwc.Close()
+		if rwc, err = net.Dial("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
 	buf := make([]byte, 4)
 	put32(buf, magic)
 	if _, err = rwc.Write(buf); err != nil {
 		return nil, err
 	}
-	conn := newConn(nil, rwc)
-	cli := &Conn{
-		respHeadBuf: make([]byte, respHeadLen),
-		readyCh:     make(chan bool, 1),
-		conn:        conn,
-	}
+	cli.conn = newConn(nil, rwc, cli.logger)
+	cli.metrics.addActiveConns(sideClient, 1)
 	cli.setFree()
 	return cli, nil
 }
 
+// handshakeMux reports whether the server answers muxMagic.
+func handshakeMux(rwc net.Conn) bool {
+	buf := make([]byte, 4)
+	put32(buf, muxMagic)
+	if _, err := rwc.Write(buf); err != nil {
+		return false
+	}
+	rwc.SetReadDeadline(time.Now().Add(muxHandshakeTimeout))
+	defer rwc.SetReadDeadline(time.Time{})
+	if _, err := io.ReadFull(rwc, buf); err != nil {
+		return false
+	}
+	return get32(buf) == muxMagic
+}
+
+// broken reports whether the error of a call breaks the connection. Only the
+// failure of the session breaks a multiplexed connection, not that of a stream.
+func (client *Conn) broken(err error) bool {
+	if err == nil || IsNonSeriousError(err) {
+		return false
+	}
+	return client.mux == nil || client.mux.closed() || errors.Is(err, errMuxClosed)
+}
+
+// acquire returns the connection for a call. release should be called after
+// the call, or after its stream response is closed. On a multiplexed connection
+// the stream of the call is reset once ctx is done, until stop is called after
+// the call returns, which reports whether the stream has been reset.
+func (client *Conn) acquire(ctx context.Context) (c *conn, release func(), stop func() bool, err error) {
+	if client.mux == nil {
+		client.waitFree()
+		return client.conn, client.setFree, func() bool { return false }, nil
+	}
+	s, err := client.mux.open()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return newConn(nil, s, client.logger), func() { s.Close() }, s.resetOnDone(ctx), nil
+}
+
 func (client *Conn) waitFree() {
 	<-client.readyCh
 }
@@ -66,6 +177,7 @@ func (client *Conn) Close() error {
 	var err error
 	client.closeOnce.Do(func() {
 		err = client.conn.rwc.Close()
+		client.metrics.addActiveConns(sideClient, -1)
 	})
 	return err
 }
@@ -76,15 +188,8 @@ type RequestArg struct {
 	Data     interface{}
 }
 
-func (client *Conn) call(requestLine string, args []*RequestArg) (resp interface{}, err error) {
-	client.waitFree()
-	var streamResponse bool
-	defer func() {
-		if !streamResponse {
-			client.setFree()
-		}
-	}()
-	if _, err = io.WriteString(client.conn.bufw, requestLine); err != nil {
+func (client *Conn) call(c *conn, requestLine string, args []*RequestArg, finish func()) (resp interface{}, err error) {
+	if _, err = io.WriteString(c.bufw, requestLine); err != nil {
 		return nil, err
 	}
 	var reqStreamArg *RequestArg
@@ -95,34 +200,35 @@ func (client *Conn) call(requestLine string, args []*RequestArg) (resp interface
 			}
 			reqStreamArg = args[i]
 		}
-		data, err := client.conn.marshal(reflect.ValueOf(args[i].Data), args[i].TypeKind, args[i].TypeName)
+		data, err := c.marshal(reflect.ValueOf(args[i].Data), args[i].TypeKind, args[i].TypeName)
 		if err != nil {
 			return nil, err
 		}
-		if _, err := client.conn.bufw.Write(data); err != nil {
+		if _, err := c.bufw.Write(data); err != nil {
 			return nil, err
 		}
 	}
-	client.conn.bufw.Flush()
+	c.bufw.Flush()
 	if reqStreamArg != nil {
-		err = client.sendStream(reqStreamArg)
+		client.metrics.addActiveStreams(sideClient, 1)
+		err = sendStream(c, reqStreamArg)
+		client.metrics.addActiveStreams(sideClient, -1)
 		if err != nil {
 			return
 		}
 	}
-	resp, err, streamResponse = client.parseResp()
-	return
+	return parseResp(c, finish)
 }
 
-func (client *Conn) sendStream(reqStreamArg *RequestArg) error {
+func sendStream(c *conn, reqStreamArg *RequestArg) error {
 	data := reqStreamArg.Data
 	switch reqStreamArg.TypeName {
 	case "istream":
-		return client.conn.responseIStream(data.(io.Reader))
+		return c.responseIStream(data.(io.Reader))
 	case "ostream":
-		return client.conn.responseOStream(data.(io.Writer))
+		return c.responseOStream(data.(io.Writer))
 	case "stream":
-		return client.conn.responseIOStream(data.(io.ReadWriter))
+		return c.responseIOStream(data.(io.ReadWriter))
 	default:
 		return errBadStreamType
 	}
@@ -135,10 +241,10 @@ type response struct {
 	data     []byte
 }
 
-func (client *Conn) readRespLine() (resp *response, err error) {
-	r := client.conn.bufr
+func readRespLine(c *conn) (resp *response, err error) {
+	r := c.bufr
 	resp = new(response)
-	buf := client.respHeadBuf
+	buf := make([]byte, respHeadLen)
 	if _, err = io.ReadFull(r, buf); err != nil {
 		return
 	}
@@ -156,8 +262,10 @@ func (client *Conn) readRespLine() (resp *response, err error) {
 	return
 }
 
-func (client *Conn) parseResp() (resp interface{}, err error, streamResponse bool) {
-	res, err := client.readRespLine()
+// parseResp reads the response, finish is called when the stream response is
+// closed.
+func parseResp(c *conn, finish func()) (resp interface{}, err error) {
+	res, err := readRespLine(c)
 	if err != nil {
 		return
 	}
@@ -165,46 +273,41 @@ func (client *Conn) parseResp() (resp interface{}, err error, streamResponse boo
 	case typeKind_Normal:
 		f, ok := builtinUnmarshal[res.typeName]
 		if !ok {
-			err = errBadRequestType
-			return
+			return nil, errBadRequestType
 		}
 		v, err := f(res.data)
 		if err != nil {
-			return nil, err, false
+			return nil, err
 		}
-		return (*v).Interface(), nil, false
+		return (*v).Interface(), nil
 	case typeKind_Error:
-		return nil, &NonSeriousError{errMsg: string(res.data)}, false
+		return nil, newNonSeriousError(parseCode(res.typeName), string(res.data))
 	case typeKind_Message:
-		return res.data, nil, false
+		return res.data, nil
 	case typeKind_Stream:
-		resp, err = client.genStream(res.typeName)
-		streamResponse = true
-		return
+		return genStream(c, res.typeName, finish)
 	case typeKind_NoRtnValue:
-		return nil, nil, false
+		return nil, nil
 	default:
-		return nil, errInvalidKind, false
+		return nil, errInvalidKind
 	}
 }
 
-func (client *Conn) genStream(typeName string) (interface{}, error) {
-	r := client.conn.bufr
-	w := client.conn.rwc
+func genStream(c *conn, typeName string, finish func()) (interface{}, error) {
 	switch typeName {
 	case "istream":
 		fallthrough
 	case "stream":
 		return &chunkReadWriteCloser{
-			client: client,
+			finish: finish,
 			readWriter: &readWriter{
-				Reader: &chunkReader{bufr: r},
-				Writer: &chunkWriter{w: w},
+				Reader: c.newChunkReader(),
+				Writer: c.newChunkWriter(),
 			}}, nil
 	case "ostream":
 		return &chunkWriteCloser{
-			client:      client,
-			chunkWriter: &chunkWriter{w: w},
+			finish:      finish,
+			chunkWriter: c.newChunkWriter(),
 		}, nil
 	default:
 		return nil, errBadStreamType
@@ -213,7 +316,7 @@ func (client *Conn) genStream(typeName string) (interface{}, error) {
 
 type chunkWriteCloser struct {
 	*chunkWriter
-	client *Conn
+	finish func()
 	wLock  sync.Mutex
 }
 
@@ -231,7 +334,7 @@ func (cwc *chunkWriteCloser) Write(p []byte) (int, error) {
 
 func (cwc *chunkWriteCloser) Close() error {
 	_, err := cwc.chunkWriter.Write(nil)
-	cwc.client.setFree()
+	cwc.finish()
 	return err
 }
 
@@ -239,7 +342,7 @@ type chunkReadWriteCloser struct {
 	rLock sync.Mutex
 	wLock sync.Mutex
 	*readWriter
-	client *Conn
+	finish func()
 }
 
 func (crwc *chunkReadWriteCloser) Write(p []byte) (int, error) {
@@ -267,40 +370,100 @@ func (crwc *chunkReadWriteCloser) Close() error {
 	if err == nil {
 		err = er
 	}
-	crwc.client.setFree()
+	crwc.finish()
 	return err
 }
 
-type NonSeriousError struct {
-	errMsg string
-}
-
-func (e *NonSeriousError) Error() string {
-	return e.errMsg
-}
-
-func IsNonSeriousError(err error) bool {
-	_, ok := err.(*NonSeriousError)
-	return ok
-}
-
 //如果返回值是normal类型，则resp就是对应类型的value。
 //如果是error类型，则resp就是nil，然后返回NonSeriousError
 //如果是message类型，则resp是[]byte
 //如果是stream类型，则resp就是io.ReadCloser、io.WriteCloser或者io.ReadWriteCloser
 func (client *Conn) Call(service, method string, args ...*RequestArg) (resp interface{}, err error) {
+	return client.CallContext(context.Background(), service, method, args...)
+}
+
+// CallContext is like Call, and ctx carries the metadata sent with the request
+// and the parent span of the call. On a multiplexed connection, the call is
+// aborted with ctx.Err() once ctx is done, and the context of the handler is
+// canceled. Without multiplexing, a sent request can not be aborted and ctx is
+// only used for the metadata.
+func (client *Conn) CallContext(ctx context.Context, service, method string, args ...*RequestArg) (resp interface{}, err error) {
 	if client.closed {
 		return nil, errClientClosed
 	}
+	md := OutgoingMetadata(ctx)
+	if client.tokens != nil {
+		token, err := client.tokens(ctx)
+		if err != nil {
+			return nil, Errorf(CodeUnauthenticated, "rpch: get token: %v", err)
+		}
+		md.Set(authorizationKey, "Bearer "+token)
+	}
+	start := time.Now()
+	var sc SpanContext
+	if parent := SpanFromContext(ctx); parent != nil {
+		sc = parent.Context
+	}
+	span := client.tracer.start(SpanKindClient, service, method, sc, client.conn.rwc.RemoteAddr())
+	if span != nil {
+		sc = span.Context
+	}
+	//the trace context is propagated even if the client has no tracer
+	if sc.IsValid() {
+		injectSpanContext(md, sc)
+	}
+	var c *conn
+	var release func()
+	var in, out int64
 	defer func() {
 		if e := recover(); e != nil {
-			log.Printf("recovered err: %v\n", e)
+			client.logger.Log(LevelError, "panic recovered in call", F(FieldRemoteAddr, client.conn.rwc.RemoteAddr()), F(FieldService, service), F(FieldMethod, method), F(FieldPanic, e))
 		}
-		if err != nil && !IsNonSeriousError(err) {
+		//a failed stream does not break the other streams of a multiplexed
+		//connection, whose calls fail by the session once it is closed
+		if client.mux == nil && client.broken(err) {
 			client.closed = true
 		}
+		if span != nil {
+			span.finish(err)
+		}
+		client.metrics.observeRequest(sideClient, service, method, ErrorCode(err), time.Since(start))
+		if c == nil {
+			return
+		}
+		switch resp.(type) {
+		case *chunkReadWriteCloser, *chunkWriteCloser:
+			//the stream bytes are counted and the connection is released when
+			//the stream is closed
+			client.metrics.addActiveStreams(sideClient, 1)
+		default:
+			in2, out2 := c.streamBytes()
+			client.metrics.addStreamBytes(sideClient, service, method, in2-in, out2-out)
+			release()
+		}
 	}()
+	var stop func() bool
+	if c, release, stop, err = client.acquire(ctx); err != nil {
+		return nil, err
+	}
+	in, out = c.streamBytes()
+	finish := func() {
+		in2, out2 := c.streamBytes()
+		client.metrics.addStreamBytes(sideClient, service, method, in2-in, out2-out)
+		client.metrics.addActiveStreams(sideClient, -1)
+		release()
+	}
 	seq := client.getSeq()
-	requestLine := fmt.Sprintf("%s %s %d %d\r\n", service, method, len(args), seq)
-	return client.call(requestLine, args)
+	if span != nil {
+		span.setSeq(seq)
+	}
+	requestLine := fmt.Sprintf("%s %s %d %d", service, method, len(args), seq)
+	if len(md) != 0 {
+		requestLine += " " + md.encode()
+	}
+	resp, err = client.call(c, requestLine+"\r\n", args, finish)
+	if stop() && err != nil {
+		err = ctx.Err()
+	}
+	return resp, err
 }
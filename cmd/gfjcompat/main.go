@@ -0,0 +1,51 @@
+// gfjcompat reports the changes between two versions of a .gfj schema, and
+// exits with status 1 if there are breaking changes.
+//
+// Usage:
+//
+//	gfjcompat [-breaking] old.gfj new.gfj
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gufeijun/rpch-go/gfj"
+)
+
+var onlyBreaking = flag.Bool("breaking", false, "only print breaking changes")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gfjcompat [-breaking] old.gfj new.gfj\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	oldFile, err := gfj.ParseFile(flag.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	newFile, err := gfj.ParseFile(flag.Arg(1))
+	if err != nil {
+		fatal(err)
+	}
+	report := gfj.Compare(oldFile, newFile)
+	for _, c := range report.Changes {
+		if c.Breaking || !*onlyBreaking {
+			fmt.Println(c)
+		}
+	}
+	if report.HasBreaking() {
+		os.Exit(1)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(2)
+}
@@ -0,0 +1,305 @@
+// rpchcurl makes ad-hoc calls to a rpch server.
+//
+// Usage:
+//
+//	rpchcurl [flags] addr list
+//	rpchcurl [flags] addr describe Service|Message
+//	rpchcurl [flags] addr Service.Method [args...]
+//
+// The method signatures are got from the reflection service of the server. If
+// the server has no reflection service, give the argument types by -t.
+// Arguments are given on the command line, or as a JSON array by -d. Stream
+// arguments should be "-", which are bound to stdin and stdout, and so are
+// the streams returned by methods.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	rpch "github.com/gufeijun/rpch-go"
+)
+
+var (
+	data     = flag.String("d", "", "arguments as a JSON array, @file reads it from file")
+	argTypes = flag.String("t", "", "comma separated argument types, used when the server has no reflection service")
+	jsonOut  = flag.Bool("json", false, "print results and errors as JSON")
+	token    = flag.String("token", "", "bearer token sent with each call")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage:
+	rpchcurl [flags] addr list
+	rpchcurl [flags] addr describe Service|Message
+	rpchcurl [flags] addr Service.Method [args...]
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var opts []rpch.DialOption
+	if *token != "" {
+		opts = append(opts, rpch.WithToken(rpch.StaticToken(*token)))
+	}
+	conn, err := rpch.Dial(flag.Arg(0), opts...)
+	if err != nil {
+		fatal(err)
+	}
+	defer conn.Close()
+	dc := rpch.NewDynamicClient(conn)
+	args := flag.Args()[2:]
+	switch cmd := flag.Arg(1); cmd {
+	case "list":
+		err = list(dc)
+	case "describe":
+		if len(args) != 1 {
+			usage()
+			os.Exit(2)
+		}
+		err = describe(dc, args[0])
+	default:
+		err = call(conn, dc, cmd, args)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func list(dc *rpch.DynamicClient) error {
+	services, err := dc.ListServices()
+	if err != nil {
+		return reflectionErr(err)
+	}
+	if *jsonOut {
+		return printJSON(services)
+	}
+	for _, service := range services {
+		fmt.Println(service)
+	}
+	return nil
+}
+
+func describe(dc *rpch.DynamicClient, name string) error {
+	service, err := dc.DescribeService(name)
+	if err == nil {
+		if *jsonOut {
+			return printJSON(service)
+		}
+		fmt.Printf("service %s{\n", service.Name)
+		for _, m := range service.Methods {
+			retTypeName := m.RetTypeName
+			if m.RetTypeKind == rpch.RetKindVoid {
+				retTypeName = "void"
+			}
+			fmt.Printf("    %s %s(%s)\n", retTypeName, m.Name, strings.Join(m.ArgTypes, ","))
+		}
+		fmt.Println("}")
+		return nil
+	}
+	if rpch.ErrorCode(err) != rpch.CodeUnimplemented {
+		return err
+	}
+	msg, er := dc.DescribeMessage(name)
+	if er != nil {
+		//report the error of DescribeService, which tells whether the server has reflection service
+		return reflectionErr(err)
+	}
+	if *jsonOut {
+		return printJSON(msg)
+	}
+	fmt.Printf("message %s{\n", msg.Name)
+	for _, f := range msg.Fields {
+		fmt.Printf("    %s %s\n", f.Type, f.Name)
+	}
+	fmt.Println("}")
+	return nil
+}
+
+func call(conn *rpch.Conn, dc *rpch.DynamicClient, target string, args []string) error {
+	i := strings.LastIndex(target, ".")
+	if i <= 0 || i == len(target)-1 {
+		return fmt.Errorf("bad method %q, expected Service.Method", target)
+	}
+	service, method := target[:i], target[i+1:]
+	values, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	var methodInfo *rpch.MethodInfo
+	if *argTypes != "" {
+		methodInfo = &rpch.MethodInfo{Name: method}
+		for _, t := range strings.Split(*argTypes, ",") {
+			methodInfo.ArgTypes = append(methodInfo.ArgTypes, strings.TrimSpace(t))
+		}
+	} else if methodInfo, err = dc.DescribeMethod(service, method); err != nil {
+		return reflectionErr(err)
+	}
+	for i, t := range methodInfo.ArgTypes {
+		//bind stream arguments to stdin and stdout
+		if i < len(values) && rpch.IsStreamType(t) {
+			if values[i] != "-" {
+				return fmt.Errorf("argument %d is %s, which should be -", i+1, t)
+			}
+			values[i] = stdio
+		}
+	}
+	reqArgs, err := dc.BuildArgs(methodInfo, values...)
+	if err != nil {
+		return err
+	}
+	resp, err := conn.Call(service, method, reqArgs...)
+	if err != nil {
+		return err
+	}
+	return printResult(resp, methodInfo.RetTypeName)
+}
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+var stdio = &readWriter{Reader: os.Stdin, Writer: os.Stdout}
+
+func parseArgs(args []string) ([]interface{}, error) {
+	if *data == "" {
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			values[i] = arg
+		}
+		return values, nil
+	}
+	if len(args) != 0 {
+		return nil, fmt.Errorf("arguments should not be given on command line with -d")
+	}
+	buf := []byte(*data)
+	if strings.HasPrefix(*data, "@") {
+		var err error
+		if buf, err = ioutil.ReadFile((*data)[1:]); err != nil {
+			return nil, err
+		}
+	}
+	var values []interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(buf)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, fmt.Errorf("-d should be a JSON array: %v", err)
+	}
+	return values, nil
+}
+
+// retTypeName is empty if the method is not known by reflection.
+func printResult(resp interface{}, retTypeName string) error {
+	switch v := resp.(type) {
+	case nil:
+		return nil
+	case []byte:
+		//message
+		if json.Valid(v) {
+			return printJSON(json.RawMessage(v))
+		}
+		_, err := os.Stdout.Write(v)
+		return err
+	case io.ReadWriteCloser:
+		if retTypeName == "istream" {
+			_, err := io.Copy(os.Stdout, v)
+			if er := v.Close(); err == nil {
+				err = er
+			}
+			return err
+		}
+		return pipeStream(v)
+	case io.WriteCloser:
+		if _, err := io.Copy(v, os.Stdin); err != nil {
+			v.Close()
+			return err
+		}
+		return v.Close()
+	default:
+		if *jsonOut {
+			return printJSON(v)
+		}
+		fmt.Println(v)
+		return nil
+	}
+}
+
+// pipeStream copies the stream returned by server to stdout, and stdin to the
+// stream until the server ends the stream. The return type is unknown with -t,
+// in which case an istream is piped too.
+func pipeStream(stream io.ReadWriteCloser) error {
+	w := &stopWriter{w: stream}
+	go io.Copy(w, os.Stdin)
+	_, err := io.Copy(os.Stdout, stream)
+	//the goroutine may still wait for stdin, which should not write to the
+	//stream after it is closed
+	w.stop()
+	if er := stream.Close(); err == nil {
+		err = er
+	}
+	return err
+}
+
+// stopWriter writes to w until stop is called.
+type stopWriter struct {
+	lock    sync.Mutex
+	w       io.Writer
+	stopped bool
+}
+
+func (sw *stopWriter) Write(p []byte) (int, error) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	if sw.stopped {
+		return 0, io.ErrClosedPipe
+	}
+	return sw.w.Write(p)
+}
+
+func (sw *stopWriter) stop() {
+	sw.lock.Lock()
+	sw.stopped = true
+	sw.lock.Unlock()
+}
+
+func printJSON(v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(buf))
+	return nil
+}
+
+func reflectionErr(err error) error {
+	if rpch.ErrorCode(err) == rpch.CodeUnimplemented && strings.Contains(err.Error(), "non-existent service") {
+		return fmt.Errorf("%w: the server has no reflection service, use -t to give argument types", err)
+	}
+	return err
+}
+
+func fatal(err error) {
+	code := rpch.ErrorCode(err)
+	if *jsonOut {
+		printJSON(map[string]string{
+			"code":    code.String(),
+			"message": err.Error(),
+		})
+	} else {
+		fmt.Fprintf(os.Stderr, "error(%s): %v\n", code, err)
+	}
+	os.Exit(1)
+}
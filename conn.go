@@ -9,7 +9,9 @@ import (
 	"io/ioutil"
 	"net"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,20 +22,42 @@ type conn struct {
 	onfinish  func()
 	finished  bool
 	svr       *Server
+	logger    Logger
 	rwc       net.Conn
 	bufr      *bufio.Reader
 	bufw      *errBufWriter
 	closeOnce sync.Once
 	seqsBuf   []byte
+	//bytes of stream data read and written
+	streamIn  int64
+	streamOut int64
+	//counter is rwc, which counts all bytes read and written
+	counter     *countingConn
+	connectedAt time.Time
+	requests    uint64
+	state       int32
+	//overLimit is set if the connection is beyond LimitConfig.MaxConns
+	overLimit bool
+	//parent is the multiplexed connection of a stream, whose state is derived
+	//from the numbers of its busy and streaming streams
+	parent    *conn
+	stream    *muxStream
+	muxLock   sync.Mutex
+	busy      int
+	streaming int
 }
 
-func newConn(svr *Server, rwc net.Conn) *conn {
+func newConn(svr *Server, rwc net.Conn, logger Logger) *conn {
+	counter := &countingConn{Conn: rwc}
 	return &conn{
-		seqsBuf: make([]byte, seqSize),
-		svr:     svr,
-		rwc:     rwc,
-		bufr:    bufio.NewReader(rwc),
-		bufw:    &errBufWriter{bufw: bufio.NewWriter(rwc)},
+		seqsBuf:     make([]byte, seqSize),
+		svr:         svr,
+		logger:      logger,
+		rwc:         counter,
+		bufr:        bufio.NewReader(counter),
+		bufw:        &errBufWriter{bufw: bufio.NewWriter(counter)},
+		counter:     counter,
+		connectedAt: time.Now(),
 	}
 }
 
@@ -72,6 +96,18 @@ func (c *conn) setWriteDeadline() error {
 	return c.rwc.SetWriteDeadline(time.Now().Add(c.svr.WriteTimeOut))
 }
 
+func (c *conn) newChunkReader() *chunkReader {
+	return &chunkReader{bufr: c.bufr, count: &c.streamIn}
+}
+
+func (c *conn) newChunkWriter() *chunkWriter {
+	return &chunkWriter{w: c.rwc, count: &c.streamOut}
+}
+
+func (c *conn) streamBytes() (in, out int64) {
+	return atomic.LoadInt64(&c.streamIn), atomic.LoadInt64(&c.streamOut)
+}
+
 func (c *conn) Read(buf []byte) (n int, err error) {
 	return c.bufr.Read(buf)
 }
@@ -104,14 +140,27 @@ func (c *conn) readRequest() (req *request, err error) {
 	if _, err = fmt.Sscanf(string(line), "%s%s%d%d", &req.service, &req.method, &req.argCnt, &req.seq); err != nil {
 		return nil, errBadRequestLine
 	}
+	//the optional fifth field is the url-encoded metadata
+	if fields := strings.Fields(string(line)); len(fields) > 4 {
+		if req.metadata, err = decodeMetadata(fields[4]); err != nil {
+			return nil, errBadRequestLine
+		}
+	}
 	req.argReader = newNetArgReader(c)
 	req.conn = c
 	return
 }
 
+func (c *conn) sendErrorResponse(err error, seq uint64) error {
+	put64(c.seqsBuf, seq)
+	c.bufw.Write(c.seqsBuf)
+	return c.sendError(err)
+}
+
+// the code of error is sent as the type name
 func (c *conn) sendError(err error) error {
 	errMsg := err.Error()
-	headBuf := _putHeader(typeKind_Error, "", len(errMsg), func(buf []byte) {
+	headBuf := _putHeader(typeKind_Error, ErrorCode(err).String(), len(errMsg), func(buf []byte) {
 		copy(buf, []byte(errMsg))
 	})
 	c.bufw.Write(headBuf)
@@ -130,17 +179,20 @@ func (c *conn) sendResponse(rtns []reflect.Value, methodDesc *MethodDesc, seq ui
 		if !rtns[1].IsNil() {
 			c.onfinish = rtns[1].Interface().(func())
 		}
+		//responseIOStream calls onfinish once the client finishes writing,
+		//otherwise it is called here
 		defer func() {
-			if c.finished {
+			if !c.finished && c.onfinish != nil {
 				c.onfinish()
 			}
+			c.onfinish = nil
+			c.finished = false
 		}()
 	}
 	put64(c.seqsBuf, seq)
 	c.bufw.Write(c.seqsBuf)
-	e := rtns[len(rtns)-1]
-	if err := e.Interface(); err != nil {
-		return c.sendError(err.(error))
+	if err := rtnError(rtns); err != nil {
+		return c.sendError(err)
 	}
 	if len(rtns) == 1 {
 		return c.sendNoRtnValue()
@@ -182,6 +234,12 @@ func (c *conn) marshal(v reflect.Value, typeKind uint16, typeName string) ([]byt
 
 func (c *conn) responseStream(v interface{}, typeName string) error {
 	c.bufw.Flush()
+	c.svr.Metrics.addActiveStreams(sideServer, 1)
+	c.setState(StateStreaming)
+	defer func() {
+		c.svr.Metrics.addActiveStreams(sideServer, -1)
+		c.setState(StateActive)
+	}()
 	switch typeName {
 	case "istream":
 		//client should write 0\r\n\r\n to tell the server to end stream reading
@@ -197,7 +255,7 @@ func (c *conn) responseStream(v interface{}, typeName string) error {
 
 func (c *conn) responseIOStream(rw io.ReadWriter) error {
 	ch := make(chan bool)
-	Go(func() {
+	goLog(c.logger, func() {
 		c.responseIStream(rw)
 		ch <- true
 	})
@@ -211,13 +269,13 @@ func (c *conn) responseIOStream(rw io.ReadWriter) error {
 }
 
 func (c *conn) responseOStream(w io.Writer) error {
-	cr := &chunkReader{bufr: c.bufr}
+	cr := c.newChunkReader()
 	_, err := io.Copy(w, cr)
 	return err
 }
 
 func (c *conn) responseIStream(r io.Reader) error {
-	cw := &chunkWriter{w: c.rwc}
+	cw := c.newChunkWriter()
 	if _, err := io.Copy(cw, r); err != nil {
 		return err
 	}
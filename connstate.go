@@ -0,0 +1,146 @@
+package rpch
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ConnState is the state of a server side connection, see Server.ConnState.
+type ConnState int32
+
+const (
+	// StateNew is the state of a connection just accepted, whose magic number
+	// is not read yet.
+	StateNew ConnState = iota
+	// StateIdle is the state of a connection waiting for the next request. The
+	// first transition to StateIdle means the handshake is completed.
+	StateIdle
+	// StateActive is the state of a connection whose request line is read and
+	// whose response is not sent yet.
+	StateActive
+	// StateStreaming is the state of a connection transferring the stream
+	// argument or the stream response of a request.
+	StateStreaming
+	// StateClosed is the final state of a connection.
+	StateClosed
+)
+
+var connStateNames = [...]string{"new", "idle", "active", "streaming", "closed"}
+
+func (s ConnState) String() string {
+	if s < 0 || int(s) >= len(connStateNames) {
+		return "unknown"
+	}
+	return connStateNames[s]
+}
+
+// ConnInfo is a snapshot of a live connection returned by Server.Conns.
+type ConnInfo struct {
+	RemoteAddr  net.Addr
+	ConnectedAt time.Time
+	// Requests is the number of requests served.
+	Requests uint64
+	// BytesIn and BytesOut are the bytes read and written, including the
+	// protocol overhead.
+	BytesIn  int64
+	BytesOut int64
+	State    ConnState
+}
+
+// countingConn counts the bytes read and written.
+type countingConn struct {
+	in  int64
+	out int64
+	net.Conn
+}
+
+func (cc *countingConn) Read(p []byte) (int, error) {
+	n, err := cc.Conn.Read(p)
+	atomic.AddInt64(&cc.in, int64(n))
+	return n, err
+}
+
+func (cc *countingConn) Write(p []byte) (int, error) {
+	n, err := cc.Conn.Write(p)
+	atomic.AddInt64(&cc.out, int64(n))
+	return n, err
+}
+
+func (c *conn) setState(state ConnState) {
+	if c.parent != nil {
+		from := ConnState(atomic.SwapInt32(&c.state, int32(state)))
+		c.parent.setStreamState(from, state)
+		return
+	}
+	atomic.StoreInt32(&c.state, int32(state))
+	if c.svr != nil && c.svr.ConnState != nil {
+		c.svr.ConnState(c.counter.Conn, state)
+	}
+}
+
+// setStreamState updates the state of a multiplexed connection when one of its
+// streams changes state from from to to. The connection is streaming if any
+// stream is streaming, active if any stream is active, or else idle.
+func (c *conn) setStreamState(from, to ConnState) {
+	c.muxLock.Lock()
+	defer c.muxLock.Unlock()
+	count := func(state ConnState, delta int) {
+		if state == StateActive || state == StateStreaming {
+			c.busy += delta
+		}
+		if state == StateStreaming {
+			c.streaming += delta
+		}
+	}
+	count(from, -1)
+	count(to, 1)
+	state := StateIdle
+	if c.streaming > 0 {
+		state = StateStreaming
+	} else if c.busy > 0 {
+		state = StateActive
+	}
+	if ConnState(atomic.LoadInt32(&c.state)) != state {
+		c.setState(state)
+	}
+}
+
+func (c *conn) info() ConnInfo {
+	return ConnInfo{
+		RemoteAddr:  c.rwc.RemoteAddr(),
+		ConnectedAt: c.connectedAt,
+		Requests:    atomic.LoadUint64(&c.requests),
+		BytesIn:     atomic.LoadInt64(&c.counter.in),
+		BytesOut:    atomic.LoadInt64(&c.counter.out),
+		State:       ConnState(atomic.LoadInt32(&c.state)),
+	}
+}
+
+func (svr *Server) trackConn(c *conn, add bool) {
+	svr.lock.Lock()
+	defer svr.lock.Unlock()
+	if add {
+		if svr.conns == nil {
+			svr.conns = make(map[*conn]struct{})
+		}
+		svr.conns[c] = struct{}{}
+	} else {
+		delete(svr.conns, c)
+	}
+}
+
+// Conns returns the snapshots of live connections in the order they connect.
+func (svr *Server) Conns() []ConnInfo {
+	svr.lock.Lock()
+	infos := make([]ConnInfo, 0, len(svr.conns))
+	for c := range svr.conns {
+		infos = append(infos, c.info())
+	}
+	svr.lock.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
@@ -0,0 +1,402 @@
+package rpch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// DynamicClient calls methods without code generated by hgen. It gets the
+// method signatures from the reflection service of the server, so the server
+// should call RegisterReflectionService.
+//
+// Arguments are converted to the types required by the method: numbers, strings
+// of numbers and json.Number are accepted for builtin numeric types, and
+// messages can be given as map[string]interface{}, struct, or JSON text in
+// string, []byte or json.RawMessage. Message results are decoded into
+// map[string]interface{} whose fields have the types declared by the message.
+type DynamicClient struct {
+	conn     Caller
+	lock     sync.Mutex
+	services map[string]*ServiceInfo
+	messages map[string]*MessageInfo
+}
+
+func NewDynamicClient(conn Caller) *DynamicClient {
+	return &DynamicClient{
+		conn:     conn,
+		services: make(map[string]*ServiceInfo),
+		messages: make(map[string]*MessageInfo),
+	}
+}
+
+func (dc *DynamicClient) callReflection(method string, res interface{}, args ...*RequestArg) error {
+	resp, err := dc.conn.Call(ReflectionServiceName, method, args...)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(resp.([]byte), res)
+}
+
+func (dc *DynamicClient) ListServices() ([]string, error) {
+	list := new(ServiceList)
+	if err := dc.callReflection("ListServices", list); err != nil {
+		return nil, err
+	}
+	return list.Services, nil
+}
+
+func (dc *DynamicClient) ListMessages() ([]*MessageInfo, error) {
+	list := new(MessageList)
+	if err := dc.callReflection("ListMessages", list); err != nil {
+		return nil, err
+	}
+	return list.Messages, nil
+}
+
+// DescribeService returns the signatures of the methods of the service. The
+// result is cached.
+func (dc *DynamicClient) DescribeService(name string) (*ServiceInfo, error) {
+	dc.lock.Lock()
+	info, ok := dc.services[name]
+	dc.lock.Unlock()
+	if ok {
+		return info, nil
+	}
+	info = new(ServiceInfo)
+	if err := dc.callReflection("DescribeService", info, stringArg(name)); err != nil {
+		return nil, err
+	}
+	dc.lock.Lock()
+	dc.services[name] = info
+	dc.lock.Unlock()
+	return info, nil
+}
+
+// DescribeMessage returns the schema of the message. The result is cached, so
+// is the absence of the message.
+func (dc *DynamicClient) DescribeMessage(name string) (*MessageInfo, error) {
+	dc.lock.Lock()
+	info, ok := dc.messages[name]
+	dc.lock.Unlock()
+	if ok && info == nil {
+		return nil, Errorf(CodeInvalidArgument, "rpch: no such message: %s", name)
+	}
+	if ok {
+		return info, nil
+	}
+	info = new(MessageInfo)
+	err := dc.callReflection("DescribeMessage", info, stringArg(name))
+	if err != nil && ErrorCode(err) != CodeInvalidArgument {
+		return nil, err
+	}
+	if err != nil {
+		info = nil
+	}
+	dc.lock.Lock()
+	dc.messages[name] = info
+	dc.lock.Unlock()
+	return info, err
+}
+
+func (dc *DynamicClient) DescribeMethod(service, method string) (*MethodInfo, error) {
+	info, err := dc.DescribeService(service)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range info.Methods {
+		if m.Name == method {
+			return m, nil
+		}
+	}
+	return nil, Errorf(CodeUnimplemented, "rpch: service %s has no method %s", service, method)
+}
+
+// Call calls service.method with args converted to the types of the method signature.
+// The result is a builtin value, a map[string]interface{} for message, a stream
+// like Conn.Call returns, or nil if the method returns nothing.
+func (dc *DynamicClient) Call(service, method string, args ...interface{}) (interface{}, error) {
+	methodInfo, err := dc.DescribeMethod(service, method)
+	if err != nil {
+		return nil, err
+	}
+	reqArgs, err := dc.BuildArgs(methodInfo, args...)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dc.conn.Call(service, method, reqArgs...)
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	if methodInfo.RetTypeKind != RetKindMessage {
+		return resp, nil
+	}
+	return dc.convertMessage(methodInfo.RetTypeName, json.RawMessage(resp.([]byte)))
+}
+
+// CallJSON is like Call, but args is a JSON array of the arguments.
+func (dc *DynamicClient) CallJSON(service, method string, args []byte) (interface{}, error) {
+	var values []interface{}
+	if len(bytes.TrimSpace(args)) != 0 {
+		if err := decodeJSON(args, &values); err != nil {
+			return nil, Errorf(CodeInvalidArgument, "rpch: arguments should be a JSON array: %v", err)
+		}
+	}
+	return dc.Call(service, method, values...)
+}
+
+// BuildArgs converts args to the RequestArgs of the method. methodInfo can be
+// made by hand if the server has no reflection service, then the fields of
+// message arguments are not checked.
+func (dc *DynamicClient) BuildArgs(methodInfo *MethodInfo, args ...interface{}) ([]*RequestArg, error) {
+	if len(args) != len(methodInfo.ArgTypes) {
+		return nil, Errorf(CodeInvalidArgument, "rpch: %s expects %d arguments, got %d", methodInfo.Name, len(methodInfo.ArgTypes), len(args))
+	}
+	reqArgs := make([]*RequestArg, len(args))
+	for i, typeName := range methodInfo.ArgTypes {
+		data, err := dc.convert(typeName, args[i])
+		if err != nil {
+			return nil, Errorf(CodeInvalidArgument, "rpch: invalid argument %d: %v", i+1, err)
+		}
+		reqArgs[i] = &RequestArg{
+			TypeKind: GetTypeKind(typeName),
+			TypeName: typeName,
+			Data:     data,
+		}
+	}
+	return reqArgs, nil
+}
+
+func (dc *DynamicClient) convert(typeName string, v interface{}) (interface{}, error) {
+	switch GetTypeKind(typeName) {
+	case typeKind_Normal:
+		return convertBuiltin(typeName, v)
+	case typeKind_Stream:
+		return convertStream(typeName, v)
+	default:
+		return dc.convertMessage(typeName, v)
+	}
+}
+
+func convertStream(typeName string, v interface{}) (interface{}, error) {
+	var ok bool
+	switch typeName {
+	case "istream":
+		_, ok = v.(io.Reader)
+	case "ostream":
+		_, ok = v.(io.Writer)
+	case "stream":
+		_, ok = v.(io.ReadWriter)
+	}
+	if !ok {
+		return nil, fmt.Errorf("expected %s, got %T", typeName, v)
+	}
+	return v, nil
+}
+
+// convertMessage converts v to a map whose keys are the fields of the message
+// and whose values have the field types.
+func (dc *DynamicClient) convertMessage(typeName string, v interface{}) (map[string]interface{}, error) {
+	msgInfo, err := dc.DescribeMessage(typeName)
+	if ErrorCode(err) == CodeUnimplemented {
+		//the server has no reflection service, the fields can not be checked
+		msgInfo = nil
+	} else if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	switch data := v.(type) {
+	case map[string]interface{}:
+		fields = data
+	case json.RawMessage:
+		err = decodeJSON(data, &fields)
+	case []byte:
+		err = decodeJSON(data, &fields)
+	case string:
+		err = decodeJSON([]byte(data), &fields)
+	default:
+		var buf []byte
+		if buf, err = json.Marshal(v); err == nil {
+			err = decodeJSON(buf, &fields)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expected message %s: %v", typeName, err)
+	}
+	if fields == nil {
+		return nil, fmt.Errorf("expected message %s, got null", typeName)
+	}
+	if msgInfo == nil {
+		return fields, nil
+	}
+	msg := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		fieldInfo := msgInfo.field(name)
+		if fieldInfo == nil {
+			return nil, fmt.Errorf("message %s has no field %s", typeName, name)
+		}
+		if value == nil || !dc.isIDLType(fieldInfo.Type) {
+			//leave the types unknown to IDL, e.g. slices, to the json decoder
+			msg[name] = value
+			continue
+		}
+		if value, err = dc.convert(fieldInfo.Type, value); err != nil {
+			return nil, fmt.Errorf("field %s.%s: %v", typeName, name, err)
+		}
+		msg[name] = value
+	}
+	return msg, nil
+}
+
+// isIDLType reports whether the type of message field is a builtin type or a message.
+func (dc *DynamicClient) isIDLType(typeName string) bool {
+	if IsBuiltinType(typeName) {
+		return true
+	}
+	_, err := dc.DescribeMessage(typeName)
+	return err == nil
+}
+
+func (mi *MessageInfo) field(name string) *FieldInfo {
+	for _, f := range mi.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func stringArg(s string) *RequestArg {
+	return &RequestArg{
+		TypeKind: typeKind_Normal,
+		TypeName: "string",
+		Data:     s,
+	}
+}
+
+// convertBuiltin converts v to the builtin type, reporting an error if the value
+// does not fit in it.
+func convertBuiltin(typeName string, v interface{}) (interface{}, error) {
+	t, ok := builtinTypes[typeName]
+	if !ok {
+		return nil, fmt.Errorf("unrecognized builtin type %s", typeName)
+	}
+	if n, ok := v.(json.Number); ok {
+		v = n.String()
+	}
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return nil, fmt.Errorf("expected %s, got nil", typeName)
+	}
+	out := reflect.New(t).Elem()
+	mismatch := fmt.Errorf("expected %s, got %T(%v)", typeName, v, v)
+	switch t.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			i = rv.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if rv.Uint() > math.MaxInt64 {
+				return nil, mismatch
+			}
+			i = int64(rv.Uint())
+		case reflect.Float32, reflect.Float64:
+			f := rv.Float()
+			if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return nil, mismatch
+			}
+			i = int64(f)
+		case reflect.String:
+			var err error
+			if i, err = strconv.ParseInt(rv.String(), 0, 64); err != nil {
+				return nil, mismatch
+			}
+		default:
+			return nil, mismatch
+		}
+		if out.OverflowInt(i) {
+			return nil, mismatch
+		}
+		out.SetInt(i)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if rv.Int() < 0 {
+				return nil, mismatch
+			}
+			u = uint64(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			u = rv.Uint()
+		case reflect.Float32, reflect.Float64:
+			f := rv.Float()
+			if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 {
+				return nil, mismatch
+			}
+			u = uint64(f)
+		case reflect.String:
+			var err error
+			if u, err = strconv.ParseUint(rv.String(), 0, 64); err != nil {
+				return nil, mismatch
+			}
+		default:
+			return nil, mismatch
+		}
+		if out.OverflowUint(u) {
+			return nil, mismatch
+		}
+		out.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			f = float64(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			f = float64(rv.Uint())
+		case reflect.Float32, reflect.Float64:
+			f = rv.Float()
+		case reflect.String:
+			var err error
+			if f, err = strconv.ParseFloat(rv.String(), t.Bits()); err != nil {
+				return nil, mismatch
+			}
+		default:
+			return nil, mismatch
+		}
+		if out.OverflowFloat(f) {
+			return nil, mismatch
+		}
+		out.SetFloat(f)
+	case reflect.Bool:
+		switch rv.Kind() {
+		case reflect.Bool:
+			out.SetBool(rv.Bool())
+		case reflect.String:
+			b, err := strconv.ParseBool(rv.String())
+			if err != nil {
+				return nil, mismatch
+			}
+			out.SetBool(b)
+		default:
+			return nil, mismatch
+		}
+	case reflect.String:
+		if rv.Kind() != reflect.String {
+			return nil, mismatch
+		}
+		out.SetString(rv.String())
+	}
+	return out.Interface(), nil
+}
@@ -1,18 +1,27 @@
 package rpch
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	errShortRead         = newProtoError("rpch: short read")
 	errInvalidMagic      = newProtoError("rpch: invalid magic number")
 	errInvalidKind       = newProtoError("rpch: invalid type kind")
 	errBadRequestLine    = newProtoError("rpch: invalid request line")
-	errBadRequestService = newProtoError("rpch: request non-existent service")
-	errBadRequestMethod  = newProtoError("rpch: request non-existent method ")
-	errBadRequestMessage = newProtoError("rpch: unrecognized request message")
-	errBadRequestType    = newProtoError("rpch: unrecognized request builtin type")
-	errBadRequestArgCnt  = newProtoError("rpch: request argument count dose not confirm to method signature")
 	errBadStreamType     = newProtoError("rpch: unrecognized stream type")
+	errMultipleStreamArg = newProtoError("rpch: request has more than one stream argument")
+)
+
+// errors below are reported to the client as error responses, the connection keeps alive
+var (
+	errBadRequestService = newNonSeriousError(CodeUnimplemented, "rpch: request non-existent service")
+	errBadRequestMethod  = newNonSeriousError(CodeUnimplemented, "rpch: request non-existent method")
+	errBadRequestMessage = newNonSeriousError(CodeInvalidArgument, "rpch: unrecognized request message")
+	errBadRequestType    = newNonSeriousError(CodeInvalidArgument, "rpch: unrecognized request builtin type")
+	errBadRequestKind    = newNonSeriousError(CodeInvalidArgument, "rpch: invalid type kind of request argument")
+	errBadRequestArgCnt  = newNonSeriousError(CodeInvalidArgument, "rpch: request argument count dose not confirm to method signature")
 )
 
 var (
@@ -22,6 +31,9 @@ var (
 	errBadResponse          = errors.New("rpch: return value and error can not be nil at the same time")
 )
 
+// ErrServerClosed is returned by Server.Serve after Shutdown or Close.
+var ErrServerClosed = errors.New("rpch: Server closed")
+
 type protoError struct {
 	errMsg string
 }
@@ -35,3 +47,116 @@ func newProtoError(err string) *protoError {
 func (pe *protoError) Error() string {
 	return pe.errMsg
 }
+
+// Code classifies the errors carried by error responses.
+type Code uint16
+
+const (
+	CodeOK Code = iota
+	// CodeUnknown is used for errors returned by handlers without a code
+	CodeUnknown
+	// CodeUnimplemented means the requested service or method does not exist
+	CodeUnimplemented
+	// CodeInvalidArgument means the arguments do not match the method signature
+	CodeInvalidArgument
+	// CodeInternal means the server failed to handle a valid request
+	CodeInternal
+	// CodeUnavailable means no endpoint is available to handle the call
+	CodeUnavailable
+	// CodeCircuitOpen means the call fails fast because the circuit breaker is
+	// open
+	CodeCircuitOpen
+	// CodeResourceExhausted means the server rejects the request because a
+	// limit is reached
+	CodeResourceExhausted
+	// CodeOverloaded means the server sheds the request because it is
+	// overloaded, the request can be retried later or on another server
+	CodeOverloaded
+	// CodeUnauthenticated means the request has no valid credentials
+	CodeUnauthenticated
+	// CodePermissionDenied means the client is not allowed to call the method
+	CodePermissionDenied
+)
+
+var codeNames = [...]string{
+	CodeOK:                "ok",
+	CodeUnknown:           "unknown",
+	CodeUnimplemented:     "unimplemented",
+	CodeInvalidArgument:   "invalid_argument",
+	CodeInternal:          "internal",
+	CodeUnavailable:       "unavailable",
+	CodeCircuitOpen:       "circuit_open",
+	CodeResourceExhausted: "resource_exhausted",
+	CodeOverloaded:        "overloaded",
+	CodeUnauthenticated:   "unauthenticated",
+	CodePermissionDenied:  "permission_denied",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return fmt.Sprintf("code(%d)", uint16(c))
+}
+
+func parseCode(name string) Code {
+	for c, n := range codeNames {
+		if n == name {
+			return Code(c)
+		}
+	}
+	return CodeUnknown
+}
+
+// NonSeriousError is an error that does not break the connection. Errors returned
+// by handlers and errors caused by bad requests are sent to the client as
+// NonSeriousError, so the client can keep using the connection.
+type NonSeriousError struct {
+	code   Code
+	errMsg string
+}
+
+func newNonSeriousError(code Code, errMsg string) *NonSeriousError {
+	return &NonSeriousError{
+		code:   code,
+		errMsg: errMsg,
+	}
+}
+
+// NewError returns an error with the given code. Handlers can return it to tell
+// the client why the call failed.
+func NewError(code Code, errMsg string) error {
+	return newNonSeriousError(code, errMsg)
+}
+
+func Errorf(code Code, format string, a ...interface{}) error {
+	return newNonSeriousError(code, fmt.Sprintf(format, a...))
+}
+
+func (e *NonSeriousError) Error() string {
+	return e.errMsg
+}
+
+func (e *NonSeriousError) Code() Code {
+	return e.code
+}
+
+// IsNonSeriousError reports whether err, or any error it wraps, is a
+// NonSeriousError, which does not break the connection.
+func IsNonSeriousError(err error) bool {
+	var e *NonSeriousError
+	return errors.As(err, &e)
+}
+
+// ErrorCode returns the code carried by err. It returns CodeOK for a nil error
+// and CodeUnknown for errors without a code.
+func ErrorCode(err error) Code {
+	if err == nil {
+		return CodeOK
+	}
+	var e *NonSeriousError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return CodeUnknown
+}
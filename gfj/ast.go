@@ -0,0 +1,175 @@
+// Package gfj parses the .gfj IDL files used by hgen, and prints them back.
+//
+// A .gfj file consists of service and message blocks:
+//
+//	service Math{
+//	    uint32 Add(uint32,uint32)
+//	    Quotient Divide(uint64,uint64)
+//	}
+//
+//	message Quotient{
+//	    uint64 Quo
+//	    uint64 Rem
+//	}
+//
+// Types are builtin types, stream types (stream, istream and ostream), void for
+// methods without return value, or messages defined in the file.
+package gfj
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Pos struct {
+	Filename string
+	Line     int
+	Column   int
+}
+
+func (p Pos) String() string {
+	if p.Filename == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+}
+
+type File struct {
+	Name     string
+	Services []*Service
+	Messages []*Message
+}
+
+type Service struct {
+	Pos     Pos
+	Name    string
+	Methods []*Method
+}
+
+type Method struct {
+	Pos  Pos
+	Name string
+	Args []*Arg
+	Ret  *Type
+}
+
+// Arg is an argument of method, whose name is optional.
+type Arg struct {
+	Type *Type
+	Name string
+}
+
+type Message struct {
+	Pos    Pos
+	Name   string
+	Fields []*Field
+}
+
+type Field struct {
+	Pos  Pos
+	Type *Type
+	Name string
+}
+
+type TypeKind int
+
+const (
+	KindBuiltin TypeKind = iota
+	KindStream
+	KindMessage
+	KindVoid
+)
+
+func (k TypeKind) String() string {
+	switch k {
+	case KindBuiltin:
+		return "builtin"
+	case KindStream:
+		return "stream"
+	case KindMessage:
+		return "message"
+	default:
+		return "void"
+	}
+}
+
+type Type struct {
+	Pos  Pos
+	Name string
+}
+
+var builtinTypes = map[string]bool{
+	"int8": true, "int16": true, "int32": true, "int64": true,
+	"uint8": true, "uint16": true, "uint32": true, "uint64": true,
+	"float32": true, "float64": true, "string": true, "bool": true,
+}
+
+func (t *Type) Kind() TypeKind {
+	switch {
+	case builtinTypes[t.Name]:
+		return KindBuiltin
+	case t.Name == "stream" || t.Name == "istream" || t.Name == "ostream":
+		return KindStream
+	case t.Name == "void":
+		return KindVoid
+	default:
+		return KindMessage
+	}
+}
+
+func (f *File) Service(name string) *Service {
+	for _, s := range f.Services {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (f *File) Message(name string) *Message {
+	for _, m := range f.Messages {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *Service) Method(name string) *Method {
+	for _, m := range s.Methods {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func (m *Message) Field(name string) *Field {
+	for _, f := range m.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Error is an error at a position of the file.
+type Error struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return e.Pos.String() + ": " + e.Msg
+}
+
+// ErrorList is returned by Parse when the file has several errors.
+type ErrorList []*Error
+
+func (el ErrorList) Error() string {
+	msgs := make([]string, len(el))
+	for i, e := range el {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
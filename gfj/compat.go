@@ -0,0 +1,128 @@
+package gfj
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Change is a difference between two versions of a schema.
+type Change struct {
+	// Breaking changes make the clients or servers built from the old schema
+	// fail with the new one.
+	Breaking bool
+	// Pos is the position in the new schema, or in the old schema if the
+	// changed element is removed.
+	Pos Pos
+	Msg string
+}
+
+func (c *Change) String() string {
+	kind := "compatible"
+	if c.Breaking {
+		kind = "breaking"
+	}
+	return fmt.Sprintf("%s: %s: %s", c.Pos, kind, c.Msg)
+}
+
+type Report struct {
+	Changes []*Change
+}
+
+func (r *Report) HasBreaking() bool {
+	for _, c := range r.Changes {
+		if c.Breaking {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Report) String() string {
+	lines := make([]string, len(r.Changes))
+	for i, c := range r.Changes {
+		lines[i] = c.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *Report) add(breaking bool, pos Pos, format string, a ...interface{}) {
+	r.Changes = append(r.Changes, &Change{
+		Breaking: breaking,
+		Pos:      pos,
+		Msg:      fmt.Sprintf(format, a...),
+	})
+}
+
+// Compare reports the changes from schema oldFile to schema newFile. Removing or
+// changing services, methods, argument and return types, messages and fields
+// is breaking, while adding them is compatible.
+func Compare(oldFile, newFile *File) *Report {
+	r := new(Report)
+	for _, oldSvc := range oldFile.Services {
+		newSvc := newFile.Service(oldSvc.Name)
+		if newSvc == nil {
+			r.add(true, oldSvc.Pos, "service %s removed", oldSvc.Name)
+			continue
+		}
+		for _, om := range oldSvc.Methods {
+			nm := newSvc.Method(om.Name)
+			if nm == nil {
+				r.add(true, om.Pos, "method %s.%s removed", oldSvc.Name, om.Name)
+				continue
+			}
+			compareMethod(r, oldSvc.Name, om, nm)
+		}
+		for _, nm := range newSvc.Methods {
+			if oldSvc.Method(nm.Name) == nil {
+				r.add(false, nm.Pos, "method %s.%s added", newSvc.Name, nm.Name)
+			}
+		}
+	}
+	for _, newSvc := range newFile.Services {
+		if oldFile.Service(newSvc.Name) == nil {
+			r.add(false, newSvc.Pos, "service %s added", newSvc.Name)
+		}
+	}
+	for _, om := range oldFile.Messages {
+		nm := newFile.Message(om.Name)
+		if nm == nil {
+			r.add(true, om.Pos, "message %s removed", om.Name)
+			continue
+		}
+		for _, of := range om.Fields {
+			nf := nm.Field(of.Name)
+			if nf == nil {
+				r.add(true, of.Pos, "field %s.%s removed", om.Name, of.Name)
+			} else if nf.Type.Name != of.Type.Name {
+				r.add(true, nf.Type.Pos, "field %s.%s changes type from %s to %s", om.Name, of.Name, of.Type.Name, nf.Type.Name)
+			}
+		}
+		for _, nf := range nm.Fields {
+			if om.Field(nf.Name) == nil {
+				r.add(false, nf.Pos, "field %s.%s added", nm.Name, nf.Name)
+			}
+		}
+	}
+	for _, nm := range newFile.Messages {
+		if oldFile.Message(nm.Name) == nil {
+			r.add(false, nm.Pos, "message %s added", nm.Name)
+		}
+	}
+	return r
+}
+
+func compareMethod(r *Report, service string, om, nm *Method) {
+	if len(om.Args) != len(nm.Args) {
+		r.add(true, nm.Pos, "method %s.%s changes the number of arguments from %d to %d", service, om.Name, len(om.Args), len(nm.Args))
+	} else {
+		for i := range om.Args {
+			ot, nt := om.Args[i].Type, nm.Args[i].Type
+			if ot.Name != nt.Name {
+				r.add(true, nt.Pos, "argument %d of method %s.%s changes type from %s to %s", i+1, service, om.Name, ot.Name, nt.Name)
+			}
+		}
+	}
+	if om.Ret.Name != nm.Ret.Name {
+		r.add(true, nm.Ret.Pos, "method %s.%s changes return type from %s to %s", service, om.Name, om.Ret.Name, nm.Ret.Name)
+	}
+}
@@ -0,0 +1,374 @@
+package gfj
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  Pos
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of file"
+	case tokIdent:
+		return fmt.Sprintf("identifier %s", t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+type scanner struct {
+	src  []byte
+	off  int
+	line int
+	col  int
+	file string
+}
+
+func (s *scanner) pos() Pos {
+	return Pos{Filename: s.file, Line: s.line, Column: s.col}
+}
+
+func (s *scanner) advance() {
+	if s.src[s.off] == '\n' {
+		s.line++
+		s.col = 1
+	} else {
+		s.col++
+	}
+	s.off++
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// skip skips spaces and comments.
+func (s *scanner) skip() error {
+	for s.off < len(s.src) {
+		c := s.src[s.off]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			s.advance()
+		case c == '/' && s.off+1 < len(s.src) && s.src[s.off+1] == '/':
+			for s.off < len(s.src) && s.src[s.off] != '\n' {
+				s.advance()
+			}
+		case c == '/' && s.off+1 < len(s.src) && s.src[s.off+1] == '*':
+			pos := s.pos()
+			s.advance()
+			s.advance()
+			for {
+				if s.off+1 >= len(s.src) {
+					return &Error{Pos: pos, Msg: "comment not terminated"}
+				}
+				if s.src[s.off] == '*' && s.src[s.off+1] == '/' {
+					s.advance()
+					s.advance()
+					break
+				}
+				s.advance()
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *scanner) next() (token, error) {
+	if err := s.skip(); err != nil {
+		return token{}, err
+	}
+	pos := s.pos()
+	if s.off >= len(s.src) {
+		return token{kind: tokEOF, pos: pos}, nil
+	}
+	c := s.src[s.off]
+	switch {
+	case isLetter(c):
+		start := s.off
+		for s.off < len(s.src) && (isLetter(s.src[s.off]) || isDigit(s.src[s.off])) {
+			s.advance()
+		}
+		return token{kind: tokIdent, text: string(s.src[start:s.off]), pos: pos}, nil
+	case c == '{' || c == '}' || c == '(' || c == ')' || c == ',':
+		s.advance()
+		return token{kind: tokPunct, text: string(c), pos: pos}, nil
+	default:
+		return token{}, &Error{Pos: pos, Msg: fmt.Sprintf("unexpected character %q", c)}
+	}
+}
+
+type parser struct {
+	scanner *scanner
+	tok     token
+}
+
+func (p *parser) next() error {
+	tok, err := p.scanner.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) errorf(format string, a ...interface{}) error {
+	return &Error{Pos: p.tok.pos, Msg: fmt.Sprintf(format, a...)}
+}
+
+func (p *parser) expect(punct string) error {
+	if p.tok.kind != tokPunct || p.tok.text != punct {
+		return p.errorf("expected %q, found %s", punct, p.tok)
+	}
+	return p.next()
+}
+
+func (p *parser) ident(what string) (token, error) {
+	tok := p.tok
+	if tok.kind != tokIdent {
+		return tok, p.errorf("expected %s, found %s", what, tok)
+	}
+	return tok, p.next()
+}
+
+func (p *parser) is(punct string) bool {
+	return p.tok.kind == tokPunct && p.tok.text == punct
+}
+
+// ParseFile parses the .gfj file.
+func ParseFile(filename string) (*File, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(filename, src)
+}
+
+// Parse parses the source of a .gfj file. Syntax errors are returned as *Error,
+// and semantic errors such as undefined types are returned as ErrorList.
+func Parse(filename string, src []byte) (*File, error) {
+	p := &parser{scanner: &scanner{src: src, line: 1, col: 1, file: filename}}
+	file := &File{Name: filename}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	for p.tok.kind != tokEOF {
+		keyword, err := p.ident(`"service" or "message"`)
+		if err != nil {
+			return nil, err
+		}
+		switch keyword.text {
+		case "service":
+			service, err := p.parseService(keyword.pos)
+			if err != nil {
+				return nil, err
+			}
+			file.Services = append(file.Services, service)
+		case "message":
+			message, err := p.parseMessage(keyword.pos)
+			if err != nil {
+				return nil, err
+			}
+			file.Messages = append(file.Messages, message)
+		default:
+			return nil, &Error{Pos: keyword.pos, Msg: fmt.Sprintf(`expected "service" or "message", found %s`, keyword)}
+		}
+	}
+	if errs := check(file); len(errs) != 0 {
+		return file, errs
+	}
+	return file, nil
+}
+
+func (p *parser) parseType() (*Type, error) {
+	tok, err := p.ident("type")
+	if err != nil {
+		return nil, err
+	}
+	return &Type{Pos: tok.pos, Name: tok.text}, nil
+}
+
+func (p *parser) parseService(pos Pos) (*Service, error) {
+	name, err := p.ident("service name")
+	if err != nil {
+		return nil, err
+	}
+	service := &Service{Pos: pos, Name: name.text}
+	if err = p.expect("{"); err != nil {
+		return nil, err
+	}
+	for !p.is("}") {
+		method, err := p.parseMethod()
+		if err != nil {
+			return nil, err
+		}
+		service.Methods = append(service.Methods, method)
+	}
+	return service, p.next()
+}
+
+func (p *parser) parseMethod() (*Method, error) {
+	ret, err := p.parseType()
+	if err != nil {
+		return nil, err
+	}
+	name, err := p.ident("method name")
+	if err != nil {
+		return nil, err
+	}
+	method := &Method{Pos: ret.Pos, Name: name.text, Ret: ret}
+	if err = p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.is(")") {
+		if len(method.Args) != 0 {
+			if err = p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		typ, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+		arg := &Arg{Type: typ}
+		if p.tok.kind == tokIdent {
+			arg.Name = p.tok.text
+			if err = p.next(); err != nil {
+				return nil, err
+			}
+		}
+		method.Args = append(method.Args, arg)
+	}
+	return method, p.next()
+}
+
+func (p *parser) parseMessage(pos Pos) (*Message, error) {
+	name, err := p.ident("message name")
+	if err != nil {
+		return nil, err
+	}
+	message := &Message{Pos: pos, Name: name.text}
+	if err = p.expect("{"); err != nil {
+		return nil, err
+	}
+	for !p.is("}") {
+		typ, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+		name, err := p.ident("field name")
+		if err != nil {
+			return nil, err
+		}
+		message.Fields = append(message.Fields, &Field{Pos: typ.Pos, Type: typ, Name: name.text})
+	}
+	return message, p.next()
+}
+
+// check reports the semantic errors of file.
+func check(file *File) ErrorList {
+	var errs ErrorList
+	errorf := func(pos Pos, format string, a ...interface{}) {
+		errs = append(errs, &Error{Pos: pos, Msg: fmt.Sprintf(format, a...)})
+	}
+	names := make(map[string]Pos)
+	declare := func(pos Pos, what, name string) {
+		if builtinTypes[name] || name == "stream" || name == "istream" || name == "ostream" || name == "void" {
+			errorf(pos, "%s name %s is a reserved type name", what, name)
+		} else if prev, ok := names[name]; ok {
+			errorf(pos, "%s %s redeclared, previous declaration at %s", what, name, prev)
+		} else {
+			names[name] = pos
+		}
+	}
+	type decl struct {
+		pos  Pos
+		what string
+		name string
+	}
+	var decls []decl
+	for _, m := range file.Messages {
+		decls = append(decls, decl{m.Pos, "message", m.Name})
+	}
+	for _, s := range file.Services {
+		decls = append(decls, decl{s.Pos, "service", s.Name})
+	}
+	sort.Slice(decls, func(i, j int) bool {
+		return decls[i].pos.before(decls[j].pos)
+	})
+	for _, d := range decls {
+		declare(d.pos, d.what, d.name)
+	}
+	checkType := func(t *Type) {
+		if t.Kind() == KindMessage && file.Message(t.Name) == nil {
+			errorf(t.Pos, "undefined type %s", t.Name)
+		}
+	}
+	for _, m := range file.Messages {
+		fields := make(map[string]Pos)
+		for _, f := range m.Fields {
+			if prev, ok := fields[f.Name]; ok {
+				errorf(f.Pos, "field %s.%s redeclared, previous declaration at %s", m.Name, f.Name, prev)
+			}
+			fields[f.Name] = f.Pos
+			switch f.Type.Kind() {
+			case KindStream, KindVoid:
+				errorf(f.Type.Pos, "field %s.%s can not be %s", m.Name, f.Name, f.Type.Name)
+			default:
+				checkType(f.Type)
+			}
+		}
+	}
+	for _, s := range file.Services {
+		methods := make(map[string]Pos)
+		for _, m := range s.Methods {
+			if prev, ok := methods[m.Name]; ok {
+				errorf(m.Pos, "method %s.%s redeclared, previous declaration at %s", s.Name, m.Name, prev)
+			}
+			methods[m.Name] = m.Pos
+			checkType(m.Ret)
+			var stream *Type
+			for _, arg := range m.Args {
+				switch arg.Type.Kind() {
+				case KindVoid:
+					errorf(arg.Type.Pos, "argument of %s.%s can not be void", s.Name, m.Name)
+				case KindStream:
+					if stream != nil {
+						errorf(arg.Type.Pos, "method %s.%s should at most have one stream argument", s.Name, m.Name)
+					}
+					stream = arg.Type
+				default:
+					checkType(arg.Type)
+				}
+			}
+		}
+	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Pos.before(errs[j].Pos)
+	})
+	return errs
+}
+
+func (p Pos) before(q Pos) bool {
+	return p.Line < q.Line || p.Line == q.Line && p.Column < q.Column
+}
@@ -0,0 +1,104 @@
+package gfj
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	rpch "github.com/gufeijun/rpch-go"
+)
+
+// Fprint prints file in .gfj format, services first and messages after.
+func Fprint(w io.Writer, file *File) error {
+	var buf bytes.Buffer
+	for i, s := range file.Services {
+		if i != 0 {
+			buf.WriteByte('\n')
+		}
+		fmt.Fprintf(&buf, "service %s{\n", s.Name)
+		for _, m := range s.Methods {
+			args := make([]string, len(m.Args))
+			for j, arg := range m.Args {
+				args[j] = arg.Type.Name
+				if arg.Name != "" {
+					args[j] += " " + arg.Name
+				}
+			}
+			fmt.Fprintf(&buf, "    %s %s(%s)\n", m.Ret.Name, m.Name, strings.Join(args, ","))
+		}
+		buf.WriteString("}\n")
+	}
+	for i, m := range file.Messages {
+		if i != 0 || len(file.Services) != 0 {
+			buf.WriteByte('\n')
+		}
+		fmt.Fprintf(&buf, "message %s{\n", m.Name)
+		for _, f := range m.Fields {
+			fmt.Fprintf(&buf, "    %s %s\n", f.Type.Name, f.Name)
+		}
+		buf.WriteString("}\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (f *File) String() string {
+	var buf bytes.Buffer
+	Fprint(&buf, f)
+	return buf.String()
+}
+
+// builtinNamespace prefixes the names of the services and messages of rpch,
+// which can not be parsed in IDL.
+const builtinNamespace = "rpch."
+
+// FromServer builds the file from the reflection service of the server that
+// conn connects to. The builtin services and messages of rpch, such as the
+// reflection and health services, are not included. Message fields whose types
+// can not be expressed in IDL, such as slices, keep the golang type names, so
+// the printed file may not be parsed.
+func FromServer(conn rpch.Caller) (*File, error) {
+	dc := rpch.NewDynamicClient(conn)
+	names, err := dc.ListServices()
+	if err != nil {
+		return nil, err
+	}
+	file := new(File)
+	for _, name := range names {
+		if strings.HasPrefix(name, builtinNamespace) {
+			continue
+		}
+		info, err := dc.DescribeService(name)
+		if err != nil {
+			return nil, err
+		}
+		service := &Service{Name: info.Name}
+		for _, m := range info.Methods {
+			method := &Method{Name: m.Name, Ret: &Type{Name: m.RetTypeName}}
+			if m.RetTypeKind == rpch.RetKindVoid {
+				method.Ret.Name = "void"
+			}
+			for _, t := range m.ArgTypes {
+				method.Args = append(method.Args, &Arg{Type: &Type{Name: t}})
+			}
+			service.Methods = append(service.Methods, method)
+		}
+		file.Services = append(file.Services, service)
+	}
+	messages, err := dc.ListMessages()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		if strings.HasPrefix(m.Name, builtinNamespace) {
+			continue
+		}
+		message := &Message{Name: m.Name}
+		for _, f := range m.Fields {
+			message.Fields = append(message.Fields, &Field{Type: &Type{Name: f.Type}, Name: f.Name})
+		}
+		file.Messages = append(file.Messages, message)
+	}
+	return file, nil
+}
@@ -0,0 +1,138 @@
+package rpch
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type hashKeyKey struct{}
+
+// WithHashKey returns a context whose calls are routed by key if the Balancer
+// uses ConsistentHash.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyKey{}, key)
+}
+
+// HashKeyFromContext returns the key set by WithHashKey.
+func HashKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(hashKeyKey{}).(string)
+	return key, ok
+}
+
+// HashKeyFunc extracts the routing key of a call, an empty key means the call
+// has no key.
+type HashKeyFunc func(info *PickInfo) string
+
+// ArgHashKey returns a HashKeyFunc using the i-th argument (from 0) as the key,
+// which should be of a builtin type.
+func ArgHashKey(i int) HashKeyFunc {
+	return func(info *PickInfo) string {
+		if i >= len(info.Args) || info.Args[i].TypeKind != typeKind_Normal {
+			return ""
+		}
+		return fmt.Sprint(info.Args[i].Data)
+	}
+}
+
+type ringNode struct {
+	hash uint64
+	ep   *Endpoint
+}
+
+type consistentHash struct {
+	virtualNodes int
+	keyFunc      HashKeyFunc
+	fallback     roundRobin
+	lock         sync.Mutex
+	//the endpoints and their weights the ring is built from
+	endpoints []*Endpoint
+	weights   []int
+	ring      []ringNode
+}
+
+// ConsistentHash routes the calls of the same key to the same endpoint by a hash
+// ring, on which an endpoint has virtualNodes times its weight nodes (100 if
+// virtualNodes is not positive). Adding or removing an endpoint only remaps the
+// keys near its nodes.
+//
+// The key is the one set by WithHashKey, or else extracted by keyFunc if it is
+// not nil. Calls without key are routed in turn.
+func ConsistentHash(virtualNodes int, keyFunc HashKeyFunc) Policy {
+	if virtualNodes <= 0 {
+		virtualNodes = 100
+	}
+	return &consistentHash{virtualNodes: virtualNodes, keyFunc: keyFunc}
+}
+
+func (ch *consistentHash) Pick(info *PickInfo, endpoints []*Endpoint) *Endpoint {
+	key, ok := "", false
+	if info.Ctx != nil {
+		key, ok = HashKeyFromContext(info.Ctx)
+	}
+	if !ok && ch.keyFunc != nil {
+		key = ch.keyFunc(info)
+		ok = key != ""
+	}
+	if !ok {
+		return ch.fallback.Pick(info, endpoints)
+	}
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	if ch.changed(endpoints) {
+		ch.build(endpoints)
+	}
+	h := hashString(key)
+	i := sort.Search(len(ch.ring), func(i int) bool {
+		return ch.ring[i].hash >= h
+	})
+	if i == len(ch.ring) {
+		i = 0
+	}
+	return ch.ring[i].ep
+}
+
+func (ch *consistentHash) changed(endpoints []*Endpoint) bool {
+	if len(endpoints) != len(ch.endpoints) {
+		return true
+	}
+	for i, ep := range endpoints {
+		if ep != ch.endpoints[i] || ep.Weight() != ch.weights[i] {
+			return true
+		}
+	}
+	return false
+}
+
+func (ch *consistentHash) build(endpoints []*Endpoint) {
+	ch.endpoints = append(ch.endpoints[:0], endpoints...)
+	ch.weights = ch.weights[:0]
+	ch.ring = ch.ring[:0]
+	for _, ep := range endpoints {
+		weight := ep.Weight()
+		ch.weights = append(ch.weights, weight)
+		for i := 0; i < ch.virtualNodes*weight; i++ {
+			ch.ring = append(ch.ring, ringNode{hash: hashString(ep.addr + "#" + strconv.Itoa(i)), ep: ep})
+		}
+	}
+	sort.Slice(ch.ring, func(i, j int) bool {
+		return ch.ring[i].hash < ch.ring[j].hash
+	})
+}
+
+// hashString is fnv-1a followed by the finalizer of splitmix64, which spreads
+// the hashes of similar strings.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
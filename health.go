@@ -0,0 +1,254 @@
+package rpch
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// HealthServiceName is the name of the service registered by
+// RegisterHealthService.
+const HealthServiceName = "rpch.Health"
+
+type ServingStatus uint8
+
+const (
+	StatusUnknown ServingStatus = iota
+	StatusServing
+	StatusNotServing
+)
+
+var servingStatusNames = [...]string{"unknown", "serving", "not_serving"}
+
+func (s ServingStatus) String() string {
+	if int(s) >= len(servingStatusNames) {
+		return servingStatusNames[StatusUnknown]
+	}
+	return servingStatusNames[s]
+}
+
+func parseServingStatus(name string) ServingStatus {
+	for i, n := range servingStatusNames {
+		if n == name {
+			return ServingStatus(i)
+		}
+	}
+	return StatusUnknown
+}
+
+// HealthServer keeps the serving status of services. The empty service name
+// stands for the whole server, which is serving when it is registered.
+type HealthServer struct {
+	lock     sync.Mutex
+	statuses map[string]ServingStatus
+	watchers map[string]map[chan ServingStatus]struct{}
+	shutdown bool
+	//stopped is closed by Shutdown to end the watches
+	stopped chan struct{}
+}
+
+// RegisterHealthService registers the service rpch.Health on svr, whose methods
+// are
+//
+//	string Check(string service)
+//	istream Watch(string service)
+//
+// Check returns the status name of service: serving, not_serving or unknown for
+// the services never set. Watch streams the status names separated by '\n',
+// starting with the current one, until the client closes the stream. A watch
+// holds the connection, so it should use a dedicated Conn.
+//
+// All statuses become not serving when svr starts shutting down, and then the
+// watch streams end so that they do not hold Shutdown.
+func RegisterHealthService(svr *Server) (*HealthServer, error) {
+	h := &HealthServer{
+		statuses: map[string]ServingStatus{"": StatusServing},
+		watchers: make(map[string]map[chan ServingStatus]struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if err := RegisterImpl(svr, HealthServiceName, &healthService{h}); err != nil {
+		return nil, err
+	}
+	svr.RegisterOnShutdown(h.Shutdown)
+	return h, nil
+}
+
+// SetServingStatus sets the status of service and notifies the watchers. It
+// does nothing after Shutdown until Resume.
+func (h *HealthServer) SetServingStatus(service string, status ServingStatus) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.shutdown {
+		return
+	}
+	h.setLocked(service, status)
+}
+
+func (h *HealthServer) setLocked(service string, status ServingStatus) {
+	h.statuses[service] = status
+	for ch := range h.watchers[service] {
+		//only the latest status matters to slow watchers
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- status
+	}
+}
+
+// Shutdown sets all statuses to not serving and ends the watches after sending
+// them the status, it is called when the server starts shutting down.
+func (h *HealthServer) Shutdown() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.shutdown {
+		return
+	}
+	h.shutdown = true
+	for service := range h.statuses {
+		h.setLocked(service, StatusNotServing)
+	}
+	close(h.stopped)
+}
+
+// Resume sets all statuses to serving, and enables SetServingStatus again.
+func (h *HealthServer) Resume() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.shutdown {
+		h.stopped = make(chan struct{})
+	}
+	h.shutdown = false
+	for service := range h.statuses {
+		h.setLocked(service, StatusServing)
+	}
+}
+
+func (h *HealthServer) status(service string) ServingStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.statuses[service]
+}
+
+// watch returns the channel of the statuses of service, and stopped which is
+// closed once the server shuts down.
+func (h *HealthServer) watch(service string) (ch chan ServingStatus, stopped <-chan struct{}, cancel func()) {
+	ch = make(chan ServingStatus, 1)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.watchers[service] == nil {
+		h.watchers[service] = make(map[chan ServingStatus]struct{})
+	}
+	h.watchers[service][ch] = struct{}{}
+	ch <- h.statuses[service]
+	return ch, h.stopped, func() {
+		h.lock.Lock()
+		delete(h.watchers[service], ch)
+		if len(h.watchers[service]) == 0 {
+			delete(h.watchers, service)
+		}
+		h.lock.Unlock()
+	}
+}
+
+// healthService is the rpch.Health service registered on servers.
+type healthService struct {
+	h *HealthServer
+}
+
+func (hs *healthService) Check(service string) (string, error) {
+	return hs.h.status(service).String(), nil
+}
+
+func (hs *healthService) Watch(service string) (io.Reader, func(), error) {
+	ch, stopped, cancel := hs.h.watch(service)
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case status := <-ch:
+				if _, err := io.WriteString(w, status.String()+"\n"); err != nil {
+					return
+				}
+			case <-stopped:
+				//send the not serving status before ending the stream
+				select {
+				case status := <-ch:
+					io.WriteString(w, status.String()+"\n")
+				default:
+				}
+				w.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	//called when the client closes the stream
+	return r, func() {
+		cancel()
+		close(done)
+		w.Close()
+	}, nil
+}
+
+// HealthClient calls the rpch.Health service.
+type HealthClient struct {
+	conn Caller
+}
+
+func NewHealthClient(conn Caller) *HealthClient {
+	return &HealthClient{conn: conn}
+}
+
+// Check returns the status of service, or the whole server if service is empty.
+func (hc *HealthClient) Check(ctx context.Context, service string) (ServingStatus, error) {
+	status, err := InvokeContext[string](ctx, hc.conn, HealthServiceName, "Check", service)
+	if err != nil {
+		return StatusUnknown, err
+	}
+	return parseServingStatus(status), nil
+}
+
+// Watch calls f with the status of service whenever it changes, until ctx is
+// done or f returns false. The Conn is held during the watch.
+func (hc *HealthClient) Watch(ctx context.Context, service string, f func(ServingStatus) bool) error {
+	stream, err := InvokeContext[io.ReadCloser](ctx, hc.conn, HealthServiceName, "Watch", service)
+	if err != nil {
+		return err
+	}
+	closeOnce := new(sync.Once)
+	closeStream := func() {
+		closeOnce.Do(func() { stream.Close() })
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeStream()
+		case <-stop:
+		}
+	}()
+	defer closeStream()
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			break
+		}
+		if !f(parseServingStatus(strings.TrimSpace(scanner.Text()))) {
+			return nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("rpch: health watch stream ended")
+}
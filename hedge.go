@@ -0,0 +1,241 @@
+package rpch
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// HedgePolicy decides when hedged copies of a call are sent. Only the methods
+// safe to call more than once should be hedged.
+type HedgePolicy struct {
+	// MaxAttempts is the max number of copies including the first one, the call
+	// is not hedged if it is less than 2.
+	MaxAttempts int
+	// Delay is how long to wait for the response before sending the next copy,
+	// e.g. the p95 latency of the method.
+	Delay time.Duration
+	// NonFatalCodes are the codes of errors that do not end the call, and the
+	// next copy is sent at once. Errors which break the connection are treated
+	// as CodeUnavailable. It is CodeUnavailable and CodeCircuitOpen if nil.
+	NonFatalCodes []Code
+}
+
+func (p *HedgePolicy) nonFatal(err error) bool {
+	if err == nil {
+		return false
+	}
+	code := ErrorCode(err)
+	if !IsNonSeriousError(err) {
+		code = CodeUnavailable
+	}
+	codes := p.NonFatalCodes
+	if codes == nil {
+		codes = []Code{CodeUnavailable, CodeCircuitOpen}
+	}
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// HedgeConfig configures HedgeCaller.
+type HedgeConfig struct {
+	// Policies are the policies by "Service.Method" or "Service", the calls
+	// matching neither are not hedged.
+	Policies map[string]*HedgePolicy
+	// Metrics counts the hedged copies sent and the calls won by them, which are
+	// answered successfully by a hedged copy first, if it is not nil. A hedged
+	// copy is counted once the Balancer picks an endpoint for it, the copies
+	// sent at once after non-fatal errors are not hedges.
+	Metrics *Metrics
+}
+
+// HedgeCaller sends another copy of a call if the Caller it wraps has not
+// answered within the delay, and returns the first response. The Caller should
+// be a Balancer, which sends the copies of a call to different endpoints.
+//
+// The context of the other copies is canceled once a response is returned, and
+// their responses are dropped, streams among which are closed. A Conn using
+// WithMultiplexing aborts a canceled copy and the server cancels the context of
+// its handler, while a Conn without it can not abort a sent request, so the
+// dropped copy still holds its connection until it is answered. Calls with a
+// stream argument are never hedged.
+type HedgeCaller struct {
+	caller Caller
+	config HedgeConfig
+}
+
+func NewHedgeCaller(caller Caller, config HedgeConfig) *HedgeCaller {
+	return &HedgeCaller{caller: caller, config: config}
+}
+
+func (hc *HedgeCaller) policy(service, method string) *HedgePolicy {
+	if p, ok := hc.config.Policies[service+"."+method]; ok {
+		return p
+	}
+	return hc.config.Policies[service]
+}
+
+func (hc *HedgeCaller) Call(service, method string, args ...*RequestArg) (interface{}, error) {
+	return hc.CallContext(context.Background(), service, method, args...)
+}
+
+type hedgeResult struct {
+	resp interface{}
+	err  error
+	//hedged is set for the copies sent after the delay, and picked if the
+	//Balancer picked an endpoint for the copy
+	hedged bool
+	picked bool
+}
+
+func (hc *HedgeCaller) CallContext(ctx context.Context, service, method string, args ...*RequestArg) (interface{}, error) {
+	p := hc.policy(service, method)
+	if p == nil || p.MaxAttempts < 2 || hasStreamArg(args) {
+		return hc.caller.CallContext(ctx, service, method, args...)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	set := new(hedgeSet)
+	results := make(chan hedgeResult, p.MaxAttempts)
+	sent, pending := 0, 0
+	//timer fires when the next copy should be sent
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	send := func(hedged bool) {
+		sent++
+		pending++
+		hcopy := &hedgeCopy{set: set}
+		if hedged {
+			hcopy.onPick = func() { hc.config.Metrics.addHedge(service, method, false) }
+		}
+		go func() {
+			resp, err := hc.caller.CallContext(context.WithValue(ctx, hedgeKey{}, hcopy), service, method, args...)
+			results <- hedgeResult{resp, err, hedged, hcopy.picked}
+		}()
+		if timer != nil {
+			timer.Stop()
+		}
+		timer, timeout = nil, nil
+		if sent < p.MaxAttempts {
+			timer = time.NewTimer(p.Delay)
+			timeout = timer.C
+		}
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	send(false)
+	//failed is the result returned if all the copies fail
+	var failed *hedgeResult
+	for {
+		var r hedgeResult
+		select {
+		case <-timeout:
+			if ctx.Err() == nil {
+				send(true)
+			}
+			continue
+		case <-ctx.Done():
+			go dropHedges(results, pending)
+			return nil, ctx.Err()
+		case r = <-results:
+			pending--
+		}
+		if !p.nonFatal(r.err) {
+			//a fatal error answered by a hedged copy first is not a win
+			if r.hedged && r.err == nil {
+				hc.config.Metrics.addHedge(service, method, true)
+			}
+			go dropHedges(results, pending)
+			return r.resp, r.err
+		}
+		//the copies for which no endpoint is picked do not hide the errors of
+		//the sent ones
+		if failed == nil || r.picked || !failed.picked {
+			failed = &r
+		}
+		if sent < p.MaxAttempts && ctx.Err() == nil {
+			send(false)
+		} else if pending == 0 {
+			return failed.resp, failed.err
+		}
+	}
+}
+
+// dropHedges waits for the n copies still in flight and closes their streams.
+func dropHedges(results chan hedgeResult, n int) {
+	for ; n > 0; n-- {
+		if c, ok := (<-results).resp.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+func hasStreamArg(args []*RequestArg) bool {
+	for _, arg := range args {
+		if arg.TypeKind == typeKind_Stream {
+			return true
+		}
+	}
+	return false
+}
+
+type hedgeKey struct{}
+
+// hedgeCopy is carried by the context of a copy of a hedged call.
+type hedgeCopy struct {
+	set *hedgeSet
+	//onPick is called when the Balancer picks the endpoint of the copy, and
+	//picked is set then
+	onPick func()
+	picked bool
+}
+
+func hedgeCopyFromContext(ctx context.Context) *hedgeCopy {
+	if ctx == nil {
+		return nil
+	}
+	hc, _ := ctx.Value(hedgeKey{}).(*hedgeCopy)
+	return hc
+}
+
+// pick records ep picked by the Balancer for the copy. It is called by the
+// goroutine making the call of the copy.
+func (hc *hedgeCopy) pick(ep *Endpoint) {
+	hc.set.add(ep)
+	hc.picked = true
+	if hc.onPick != nil {
+		hc.onPick()
+	}
+}
+
+// hedgeSet records the endpoints picked by the copies of a hedged call, so that
+// the Balancer picks a different one for each copy.
+type hedgeSet struct {
+	lock      sync.Mutex
+	endpoints []*Endpoint
+}
+
+func (hs *hedgeSet) contains(ep *Endpoint) bool {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	for _, e := range hs.endpoints {
+		if e == ep {
+			return true
+		}
+	}
+	return false
+}
+
+func (hs *hedgeSet) add(ep *Endpoint) {
+	hs.lock.Lock()
+	hs.endpoints = append(hs.endpoints, ep)
+	hs.lock.Unlock()
+}
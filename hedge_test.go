@@ -0,0 +1,195 @@
+package rpch
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type hedgeTestService struct {
+	delay time.Duration
+	//canceled receives a value when the context of Wait is canceled
+	canceled chan struct{}
+}
+
+// Wait answers after the delay unless the call is canceled.
+func (s *hedgeTestService) Wait(ctx context.Context) (string, error) {
+	select {
+	case <-time.After(s.delay):
+		return "answered", nil
+	case <-ctx.Done():
+		s.canceled <- struct{}{}
+		return "", ctx.Err()
+	}
+}
+
+// Fail fails after the delay.
+func (s *hedgeTestService) Fail() (string, error) {
+	time.Sleep(s.delay)
+	return "", NewError(CodeUnavailable, "backend down")
+}
+
+func startHedgeServer(t *testing.T, delay time.Duration) (*hedgeTestService, string) {
+	t.Helper()
+	impl := &hedgeTestService{delay: delay, canceled: make(chan struct{}, 10)}
+	_, _, addr := startMuxServer(t, func(svr *Server) {
+		if err := RegisterImpl(svr, "Hedge", impl); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return impl, addr
+}
+
+// preferPolicy picks the endpoint of the address if it is a candidate.
+type preferPolicy string
+
+func (p preferPolicy) Pick(info *PickInfo, endpoints []*Endpoint) *Endpoint {
+	for _, ep := range endpoints {
+		if ep.Addr() == string(p) {
+			return ep
+		}
+	}
+	return endpoints[0]
+}
+
+func hedgeCounts(m *Metrics, service, method string) (hedges, wins int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := methodKey{service, method}
+	return m.hedges[key], m.hedgeWins[key]
+}
+
+func TestHedgeCancelsSlowCopy(t *testing.T) {
+	var calls int32
+	canceled := make(chan struct{}, 1)
+	caller := callerFunc(func(ctx context.Context, service, method string, args ...*RequestArg) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-ctx.Done()
+			canceled <- struct{}{}
+			return nil, ctx.Err()
+		}
+		return "fast", nil
+	})
+	m := NewMetrics()
+	hc := NewHedgeCaller(caller, HedgeConfig{
+		Policies: map[string]*HedgePolicy{"S": {MaxAttempts: 2, Delay: 10 * time.Millisecond}},
+		Metrics:  m,
+	})
+	resp, err := hc.Call("S", "M")
+	if err != nil || resp != "fast" {
+		t.Fatalf("got %v, %v, want the hedged response", resp, err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the slow copy is not canceled")
+	}
+	//the copy is not sent to an endpoint picked by a Balancer
+	if hedges, wins := hedgeCounts(m, "S", "M"); hedges != 0 || wins != 1 {
+		t.Fatalf("hedges %d, wins %d, want 0 and 1", hedges, wins)
+	}
+}
+
+func TestHedgeCallerContextDone(t *testing.T) {
+	stuck := make(chan struct{})
+	defer close(stuck)
+	//the copies ignore their context
+	caller := callerFunc(func(ctx context.Context, service, method string, args ...*RequestArg) (interface{}, error) {
+		<-stuck
+		return nil, nil
+	})
+	hc := NewHedgeCaller(caller, HedgeConfig{
+		Policies: map[string]*HedgePolicy{"S": {MaxAttempts: 3, Delay: time.Second}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := hc.CallContext(ctx, "S", "M")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("the hedged call ignores the deadline of the caller")
+	}
+}
+
+func TestHedgeWithoutOtherEndpoint(t *testing.T) {
+	_, addr := startHedgeServer(t, 50*time.Millisecond)
+	b := NewBalancer(Addresses(addr), WithDialOptions(WithMultiplexing(), WithLogger(NopLogger)), WithBalancerLogger(NopLogger))
+	defer b.Close()
+	m := NewMetrics()
+	hc := NewHedgeCaller(b, HedgeConfig{
+		Policies: map[string]*HedgePolicy{"Hedge": {MaxAttempts: 2, Delay: 10 * time.Millisecond}},
+		Metrics:  m,
+	})
+	//the error of the sent copy is returned, not the one of the copy for
+	//which no endpoint is left
+	_, err := hc.Call("Hedge", "Fail")
+	if ErrorCode(err) != CodeUnavailable || err.Error() != "backend down" {
+		t.Fatalf("got %v, want the error of the backend", err)
+	}
+	if hedges, wins := hedgeCounts(m, "Hedge", "Fail"); hedges != 0 || wins != 0 {
+		t.Fatalf("hedges %d, wins %d, want none", hedges, wins)
+	}
+}
+
+func TestHedgeAbortsLoserOnServer(t *testing.T) {
+	slow, slowAddr := startHedgeServer(t, 5*time.Second)
+	_, fastAddr := startHedgeServer(t, 0)
+	m := NewMetrics()
+	b := NewBalancer(Addresses(slowAddr, fastAddr),
+		WithPolicy(preferPolicy(slowAddr)),
+		WithDialOptions(WithMultiplexing(), WithLogger(NopLogger), WithMetrics(m)),
+		WithBalancerLogger(NopLogger))
+	defer b.Close()
+	hc := NewHedgeCaller(b, HedgeConfig{
+		Policies: map[string]*HedgePolicy{"Hedge": {MaxAttempts: 2, Delay: 20 * time.Millisecond}},
+		Metrics:  m,
+	})
+	resp, err := hc.Call("Hedge", "Wait")
+	if err != nil || resp != "answered" {
+		t.Fatalf("got %v, %v, want the response of the fast endpoint", resp, err)
+	}
+	//the handler of the dropped copy is canceled instead of running on
+	select {
+	case <-slow.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the handler of the dropped copy is not canceled")
+	}
+	if hedges, wins := hedgeCounts(m, "Hedge", "Wait"); hedges != 1 || wins != 1 {
+		t.Fatalf("hedges %d, wins %d, want 1 and 1", hedges, wins)
+	}
+	//the canceled copy neither breaks nor ejects the slow endpoint
+	b.lock.Lock()
+	ready := len(b.ready)
+	b.lock.Unlock()
+	if ready != 2 {
+		t.Fatalf("%d endpoints ready after the hedged call, want 2", ready)
+	}
+}
+
+func TestHedgePolicyNonFatal(t *testing.T) {
+	p := &HedgePolicy{}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{NewError(CodeUnavailable, "down"), true},
+		{NewError(CodeCircuitOpen, "open"), true},
+		{NewError(CodeInvalidArgument, "bad"), false},
+		{errors.New("connection reset"), true},
+	}
+	for _, tt := range tests {
+		if got := p.nonFatal(tt.err); got != tt.want {
+			t.Errorf("nonFatal(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package rpch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// IStream, OStream and Stream make the stream arguments explicitly, which are
+// needed when the argument implements more interfaces than the stream type,
+// e.g. passing a *os.File as istream.
+func IStream(r io.Reader) *RequestArg {
+	return &RequestArg{TypeKind: typeKind_Stream, TypeName: "istream", Data: r}
+}
+
+func OStream(w io.Writer) *RequestArg {
+	return &RequestArg{TypeKind: typeKind_Stream, TypeName: "ostream", Data: w}
+}
+
+func Stream(rw io.ReadWriter) *RequestArg {
+	return &RequestArg{TypeKind: typeKind_Stream, TypeName: "stream", Data: rw}
+}
+
+// Invoke calls service.method without code generated by hgen. The IDL types of
+// args are inferred from their golang types, see RegisterImpl. An io.ReadWriter
+// is sent as stream, use IStream or OStream to send it as other stream types.
+// Args can also be *RequestArg.
+//
+// Resp should be the golang type of the return value, e.g. uint32 for builtin,
+// *Quotient for message and io.ReadWriteCloser for stream.
+//
+//	quo, err := rpch.Invoke[*gfj.Quotient](conn, "Math", "Divide", uint64(5), uint64(2))
+func Invoke[Resp any](conn Caller, service, method string, args ...interface{}) (Resp, error) {
+	return InvokeContext[Resp](context.Background(), conn, service, method, args...)
+}
+
+// InvokeContext is like Invoke and calls with ctx, see Conn.CallContext.
+func InvokeContext[Resp any](ctx context.Context, conn Caller, service, method string, args ...interface{}) (Resp, error) {
+	var res Resp
+	reqArgs := make([]*RequestArg, len(args))
+	for i, arg := range args {
+		reqArg, ok := arg.(*RequestArg)
+		if !ok {
+			var err error
+			if reqArg, err = newRequestArg(valueType(arg), arg); err != nil {
+				return res, Errorf(CodeInvalidArgument, "rpch: invalid argument %d: %v", i+1, err)
+			}
+		}
+		reqArgs[i] = reqArg
+	}
+	resp, err := conn.CallContext(ctx, service, method, reqArgs...)
+	if err != nil {
+		return res, err
+	}
+	v, err := convertResp(resp, reflect.TypeOf(&res).Elem())
+	if err != nil {
+		return res, err
+	}
+	if v.IsValid() {
+		res = v.Interface().(Resp)
+	}
+	return res, nil
+}
+
+// NewClient fills the func fields of the struct pointed by stub with functions
+// calling the methods of service. A field calls the method of the same name,
+// or the name given by tag `rpch:"Method"`. The functions should return
+// (error) or (T, error), and the types are the same as Invoke. A function whose
+// first argument is a context.Context calls with it, see Conn.CallContext.
+//
+//	type MathClient struct {
+//		Add    func(uint32, uint32) (uint32, error)
+//		Divide func(uint64, uint64) (*gfj.Quotient, error)
+//	}
+//	client := new(MathClient)
+//	err := rpch.NewClient(conn, "Math", client)
+func NewClient(conn Caller, service string, stub interface{}) error {
+	v := reflect.ValueOf(stub)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("rpch: stub should be a pointer to struct, got %T", stub)
+	}
+	v = v.Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" || field.Type.Kind() != reflect.Func {
+			continue
+		}
+		method := field.Name
+		if tag := field.Tag.Get("rpch"); tag != "" {
+			method = tag
+		}
+		f, err := makeStubFunc(conn, service, method, field.Type)
+		if err != nil {
+			return fmt.Errorf("rpch: field %s: %v", field.Name, err)
+		}
+		v.Field(i).Set(f)
+	}
+	return nil
+}
+
+func makeStubFunc(conn Caller, service, method string, f reflect.Type) (reflect.Value, error) {
+	if f.IsVariadic() {
+		return reflect.Value{}, fmt.Errorf("variadic function is not supported")
+	}
+	//index of the first argument sent to the server
+	first := 0
+	if f.NumIn() > 0 && f.In(0) == contextType {
+		first = 1
+	}
+	for i := first; i < f.NumIn(); i++ {
+		if _, err := newRequestArg(f.In(i), nil); err != nil {
+			return reflect.Value{}, fmt.Errorf("argument %d: %v", i+1, err)
+		}
+	}
+	out := f.NumOut()
+	if out == 0 || out > 2 || f.Out(out-1) != errorType {
+		return reflect.Value{}, fmt.Errorf("should return (error) or (T, error)")
+	}
+	return reflect.MakeFunc(f, func(in []reflect.Value) []reflect.Value {
+		rtns := make([]reflect.Value, out)
+		for i := 0; i < out-1; i++ {
+			rtns[i] = reflect.Zero(f.Out(i))
+		}
+		fail := func(err error) []reflect.Value {
+			rtns[out-1] = reflect.ValueOf(&err).Elem()
+			return rtns
+		}
+		ctx := context.Background()
+		if first == 1 && !in[0].IsNil() {
+			ctx = in[0].Interface().(context.Context)
+		}
+		reqArgs := make([]*RequestArg, 0, len(in))
+		for i := first; i < len(in); i++ {
+			reqArg, err := newRequestArg(f.In(i), in[i].Interface())
+			if err != nil {
+				return fail(err)
+			}
+			reqArgs = append(reqArgs, reqArg)
+		}
+		resp, err := conn.CallContext(ctx, service, method, reqArgs...)
+		if err != nil {
+			return fail(err)
+		}
+		if out == 2 {
+			v, err := convertResp(resp, f.Out(0))
+			if err != nil {
+				return fail(err)
+			}
+			if v.IsValid() {
+				rtns[0] = v
+			}
+		}
+		rtns[out-1] = reflect.Zero(errorType)
+		return rtns
+	}), nil
+}
+
+// valueType returns the type used to infer the IDL type of v.
+func valueType(v interface{}) reflect.Type {
+	switch v.(type) {
+	case io.ReadWriter:
+		return readWriterType
+	case io.Reader:
+		return readerType
+	case io.Writer:
+		return writerType
+	}
+	return reflect.TypeOf(v)
+}
+
+// newRequestArg makes the RequestArg of v whose golang type is t.
+func newRequestArg(t reflect.Type, v interface{}) (*RequestArg, error) {
+	if t == nil {
+		return nil, fmt.Errorf("nil argument")
+	}
+	var typeName string
+	if isStreamType(t) {
+		typeName = typeNameOf(t)
+	} else {
+		var err error
+		//messages map is unused, unregistered messages are named by the struct name
+		if typeName, err = inferTypeName(t, make(map[string]reflect.Type)); err != nil {
+			return nil, err
+		}
+	}
+	return &RequestArg{
+		TypeKind: GetTypeKind(typeName),
+		TypeName: typeName,
+		Data:     v,
+	}, nil
+}
+
+// convertResp converts the resp returned by Conn.Call to type t. The returned
+// value is invalid if resp is nil.
+func convertResp(resp interface{}, t reflect.Type) (reflect.Value, error) {
+	if resp == nil {
+		return reflect.Value{}, nil
+	}
+	if data, ok := resp.([]byte); ok && t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
+		v := reflect.New(t.Elem())
+		return v, json.Unmarshal(data, v.Interface())
+	}
+	v := reflect.ValueOf(resp)
+	if !v.Type().AssignableTo(t) {
+		return reflect.Value{}, fmt.Errorf("rpch: can not convert response %T to %s", resp, t)
+	}
+	return v.Convert(t), nil
+}
@@ -0,0 +1,175 @@
+package rpch
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LimitConfig configures a Limiter, the zero value of a field means no limit.
+type LimitConfig struct {
+	// MaxConns is the max number of connections. The requests on connections
+	// beyond it get an error response, and then the connections are closed.
+	MaxConns int
+	// MaxConcurrent is the max number of requests handled at the same time.
+	MaxConcurrent int
+	// MaxConcurrentPerMethod is the max number of requests handled at the same
+	// time by "Service.Method" or "Service", both of which apply if set.
+	MaxConcurrentPerMethod map[string]int
+	// Rate is the number of requests per second allowed for each client, with
+	// bursts of at most Burst requests (at least 1).
+	Rate  float64
+	Burst int
+	// ClientKey returns the identity of the client for rate limiting, which is
+	// the remote IP by default. ctx is the context of the request, which
+	// carries the principal if the server authenticates requests.
+	ClientKey func(ctx context.Context, remote net.Addr) string
+}
+
+// Limiter limits the connections and requests of a Server, the requests beyond
+// the limits get error responses with CodeResourceExhausted. Set it to
+// Server.Limiter:
+//
+//	svr.Limiter = rpch.NewLimiter(rpch.LimitConfig{MaxConns: 1000, Rate: 100, Burst: 200})
+type Limiter struct {
+	config     LimitConfig
+	conns      int64
+	concurrent int64
+	//the concurrency counters by "Service.Method" or "Service"
+	perMethod map[string]*int64
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func NewLimiter(config LimitConfig) *Limiter {
+	l := &Limiter{
+		config:    config,
+		perMethod: make(map[string]*int64),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+	for name, max := range config.MaxConcurrentPerMethod {
+		if max > 0 {
+			l.perMethod[name] = new(int64)
+		}
+	}
+	if l.config.Burst < 1 {
+		l.config.Burst = 1
+	}
+	return l
+}
+
+// the methods below do nothing on a nil Limiter
+
+// acquireConn reports whether a new connection is within the limit, the
+// connection should call releaseConn when closed whether or not it is.
+func (l *Limiter) acquireConn() bool {
+	if l == nil {
+		return true
+	}
+	n := atomic.AddInt64(&l.conns, 1)
+	return l.config.MaxConns <= 0 || n <= int64(l.config.MaxConns)
+}
+
+func (l *Limiter) releaseConn() {
+	if l == nil {
+		return
+	}
+	atomic.AddInt64(&l.conns, -1)
+}
+
+// admit reports whether req can be handled now. If it can, release should be
+// called after the handler returns.
+func (l *Limiter) admit(req *request) (release func(), err error) {
+	release = func() {}
+	if l == nil {
+		return release, nil
+	}
+	if l.config.Rate > 0 && !l.take(l.clientKey(req)) {
+		return release, Errorf(CodeResourceExhausted, "rpch: rate limit exceeded")
+	}
+	var counters []*int64
+	defer func() {
+		if err != nil {
+			for _, c := range counters {
+				atomic.AddInt64(c, -1)
+			}
+		}
+	}()
+	if max := l.config.MaxConcurrent; max > 0 {
+		counters = append(counters, &l.concurrent)
+		if atomic.AddInt64(&l.concurrent, 1) > int64(max) {
+			return release, Errorf(CodeResourceExhausted, "rpch: too many concurrent requests")
+		}
+	}
+	for _, name := range [...]string{req.service + "." + req.method, req.service} {
+		c, ok := l.perMethod[name]
+		if !ok {
+			continue
+		}
+		counters = append(counters, c)
+		if atomic.AddInt64(c, 1) > int64(l.config.MaxConcurrentPerMethod[name]) {
+			return release, Errorf(CodeResourceExhausted, "rpch: too many concurrent requests of %s", name)
+		}
+	}
+	return func() {
+		for _, c := range counters {
+			atomic.AddInt64(c, -1)
+		}
+	}, nil
+}
+
+func (l *Limiter) clientKey(req *request) string {
+	remote := req.conn.rwc.RemoteAddr()
+	if l.config.ClientKey != nil {
+		return l.config.ClientKey(req.ctx, remote)
+	}
+	if remote == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return remote.String()
+	}
+	return host
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token from the bucket of key.
+func (l *Limiter) take(key string) bool {
+	now := time.Now()
+	burst := float64(l.config.Burst)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	//the buckets refilled to full are the same as new ones, drop them
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.config.Rate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.config.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
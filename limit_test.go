@@ -0,0 +1,123 @@
+package rpch
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// addrConn is a net.Conn of which only RemoteAddr is used.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// testRequest returns a request of Service.Method from the remote address.
+func testRequest(service, method, remote string) *request {
+	addr, _ := net.ResolveTCPAddr("tcp", remote)
+	return &request{
+		conn:     &conn{rwc: addrConn{remote: addr}},
+		service:  service,
+		method:   method,
+		metadata: Metadata{},
+		ctx:      context.Background(),
+	}
+}
+
+func TestLimiterConns(t *testing.T) {
+	l := NewLimiter(LimitConfig{MaxConns: 2})
+	if !l.acquireConn() || !l.acquireConn() {
+		t.Fatal("connections within the limit are rejected")
+	}
+	if l.acquireConn() {
+		t.Fatal("the connection beyond the limit is accepted")
+	}
+	//the rejected connection releases too
+	l.releaseConn()
+	l.releaseConn()
+	if !l.acquireConn() {
+		t.Fatal("the released connection is still counted")
+	}
+}
+
+func TestLimiterConcurrent(t *testing.T) {
+	l := NewLimiter(LimitConfig{
+		MaxConcurrent:          3,
+		MaxConcurrentPerMethod: map[string]int{"S.M": 1, "T": 2},
+	})
+	release, err := l.admit(testRequest("S", "M", "10.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.admit(testRequest("S", "M", "10.0.0.1:1")); ErrorCode(err) != CodeResourceExhausted {
+		t.Fatalf("got %v, want resource exhausted beyond the limit of S.M", err)
+	}
+	//other methods of S are not limited by S.M
+	releaseN, err := l.admit(testRequest("S", "N", "10.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.admit(testRequest("T", "A", "10.0.0.1:1")); err != nil {
+		t.Fatal(err)
+	}
+	//the rejected requests above took no slot, so MaxConcurrent is reached
+	//by the third admitted one
+	if _, err := l.admit(testRequest("T", "B", "10.0.0.1:1")); ErrorCode(err) != CodeResourceExhausted {
+		t.Fatalf("got %v, want resource exhausted beyond MaxConcurrent", err)
+	}
+	release()
+	releaseN()
+	//the per-service limit of T is not reached by the request rejected by
+	//MaxConcurrent
+	if _, err := l.admit(testRequest("T", "B", "10.0.0.1:1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.admit(testRequest("T", "C", "10.0.0.1:1")); ErrorCode(err) != CodeResourceExhausted {
+		t.Fatalf("got %v, want resource exhausted beyond the limit of T", err)
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := NewLimiter(LimitConfig{Rate: 1, Burst: 2})
+	for i := 0; i < 2; i++ {
+		if _, err := l.admit(testRequest("S", "M", "10.0.0.1:1")); err != nil {
+			t.Fatalf("request %d within the burst: %v", i, err)
+		}
+	}
+	if _, err := l.admit(testRequest("S", "M", "10.0.0.1:2")); ErrorCode(err) != CodeResourceExhausted {
+		t.Fatalf("got %v, want resource exhausted beyond the burst", err)
+	}
+	//the clients are limited separately
+	if _, err := l.admit(testRequest("S", "M", "10.0.0.2:1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimiterClientKey(t *testing.T) {
+	l := NewLimiter(LimitConfig{
+		Rate: 1,
+		ClientKey: func(ctx context.Context, remote net.Addr) string {
+			return "shared"
+		},
+	})
+	if _, err := l.admit(testRequest("S", "M", "10.0.0.1:1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.admit(testRequest("S", "M", "10.0.0.2:1")); ErrorCode(err) != CodeResourceExhausted {
+		t.Fatalf("got %v, want the clients sharing a key limited together", err)
+	}
+}
+
+func TestLimiterNil(t *testing.T) {
+	var l *Limiter
+	if !l.acquireConn() {
+		t.Fatal("nil Limiter rejects a connection")
+	}
+	release, err := l.admit(testRequest("S", "M", "10.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
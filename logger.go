@@ -0,0 +1,118 @@
+package rpch
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// Field is a key-value pair attached to a log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// the keys of fields logged by rpch
+const (
+	FieldRemoteAddr = "remote_addr"
+	FieldService    = "service"
+	FieldMethod     = "method"
+	FieldSeq        = "seq"
+	FieldDuration   = "duration"
+	FieldCode       = "code"
+	FieldError      = "error"
+	FieldPanic      = "panic"
+	FieldStack      = "stack"
+)
+
+// Logger receives the logs of servers and clients. Implementations should be
+// safe for concurrent use.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// DefaultLogger is used by servers and clients without Logger, and by Go. It
+// writes the logs of LevelInfo and above to the standard logger.
+var DefaultLogger Logger = NewStdLogger(log.Default(), LevelInfo)
+
+// NopLogger discards all logs.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, ...Field) {}
+
+type stdLogger struct {
+	l     *log.Logger
+	level Level
+}
+
+// NewStdLogger returns a Logger writing the logs of level and above to l in
+// logfmt, e.g.
+//
+//	2021/07/01 12:00:00 level=error msg="panic recovered" service=Math method=Add panic="runtime error"
+func NewStdLogger(l *log.Logger, level Level) Logger {
+	return &stdLogger{l: l, level: level}
+}
+
+func (sl *stdLogger) Log(level Level, msg string, fields ...Field) {
+	if level < sl.level {
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString("level=")
+	sb.WriteString(level.String())
+	sb.WriteString(" msg=")
+	sb.WriteString(logfmtValue(msg))
+	for _, f := range fields {
+		sb.WriteByte(' ')
+		sb.WriteString(f.Key)
+		sb.WriteByte('=')
+		sb.WriteString(logfmtValue(f.Value))
+	}
+	sl.l.Output(3, sb.String())
+}
+
+func logfmtValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case time.Duration:
+		s = v.String()
+	case error:
+		s = v.Error()
+	case []byte:
+		s = string(v)
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
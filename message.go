@@ -1,8 +1,17 @@
 package rpch
 
-import "reflect"
+import (
+	"io"
+	"reflect"
+	"sync"
+)
 
-var messageNameIDL2Golang = make(map[string]interface{})
+// messageNameIDL2Golang is read while serving, and written by RegisterMessage
+// and RegisterImpl at any time, so it is guarded by messagesLock.
+var (
+	messageNameIDL2Golang = make(map[string]interface{})
+	messagesLock          sync.RWMutex
+)
 
 func isPtr(msg interface{}) bool {
 	return reflect.ValueOf(msg).Type().Kind() == reflect.Ptr
@@ -12,5 +21,69 @@ func RegisterMessage(IDLName string, msg interface{}) {
 	for isPtr(msg) {
 		msg = reflect.Indirect(reflect.ValueOf(msg)).Interface()
 	}
+	messagesLock.Lock()
 	messageNameIDL2Golang[IDLName] = msg
+	messagesLock.Unlock()
+}
+
+func lookupMessage(IDLName string) (interface{}, bool) {
+	messagesLock.RLock()
+	defer messagesLock.RUnlock()
+	msg, ok := messageNameIDL2Golang[IDLName]
+	return msg, ok
+}
+
+// registeredMessages returns a copy of the registered messages.
+func registeredMessages() map[string]interface{} {
+	messagesLock.RLock()
+	defer messagesLock.RUnlock()
+	msgs := make(map[string]interface{}, len(messageNameIDL2Golang))
+	for name, msg := range messageNameIDL2Golang {
+		msgs[name] = msg
+	}
+	return msgs
+}
+
+var (
+	readerType     = reflect.TypeOf((*io.Reader)(nil)).Elem()
+	writerType     = reflect.TypeOf((*io.Writer)(nil)).Elem()
+	readWriterType = reflect.TypeOf((*io.ReadWriter)(nil)).Elem()
+)
+
+// messageIDLName returns the IDL name of a registered message type. t can be
+// the message struct or a pointer to it. If t is registered under several
+// names, the smallest one is returned.
+func messageIDLName(t reflect.Type) (string, bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	messagesLock.RLock()
+	defer messagesLock.RUnlock()
+	found := ""
+	for name, msg := range messageNameIDL2Golang {
+		if reflect.TypeOf(msg) == t && (found == "" || name < found) {
+			found = name
+		}
+	}
+	return found, found != ""
+}
+
+// typeNameOf returns the IDL type name of the golang type t, which is used in
+// method signatures. If t can not be expressed in IDL, t.String() is returned.
+func typeNameOf(t reflect.Type) string {
+	switch t {
+	case readWriterType:
+		return "stream"
+	case readerType:
+		return "istream"
+	case writerType:
+		return "ostream"
+	}
+	if name, ok := messageIDLName(t); ok {
+		return name
+	}
+	if _, ok := builtinMarshal[t.Kind()]; ok && t.PkgPath() == "" {
+		return t.Kind().String()
+	}
+	return t.String()
 }
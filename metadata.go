@@ -0,0 +1,100 @@
+package rpch
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+// Metadata is the key-value pairs sent along with a request, such as the trace
+// context. Keys are case insensitive and stored in lower case.
+//
+// The metadata is appended to the request line in url-encoded form, servers not
+// knowing metadata just ignore it.
+type Metadata map[string]string
+
+// NewMetadata makes Metadata from pairs of key and value.
+func NewMetadata(kv ...string) Metadata {
+	if len(kv)%2 == 1 {
+		panic("rpch: NewMetadata got an odd number of arguments")
+	}
+	md := make(Metadata, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		md.Set(kv[i], kv[i+1])
+	}
+	return md
+}
+
+func (md Metadata) Get(key string) string {
+	return md[strings.ToLower(key)]
+}
+
+func (md Metadata) Set(key, value string) {
+	md[strings.ToLower(key)] = value
+}
+
+func (md Metadata) Copy() Metadata {
+	c := make(Metadata, len(md))
+	for k, v := range md {
+		c[k] = v
+	}
+	return c
+}
+
+func (md Metadata) encode() string {
+	values := make(url.Values, len(md))
+	for k, v := range md {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
+
+func decodeMetadata(s string) (Metadata, error) {
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	md := make(Metadata, len(values))
+	for k, v := range values {
+		md.Set(k, v[0])
+	}
+	return md, nil
+}
+
+type outgoingKey struct{}
+
+type incomingKey struct{}
+
+// NewOutgoingContext returns a context carrying md, which is sent with the
+// requests made by Conn.CallContext.
+func NewOutgoingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext returns a context with the pairs of key and value
+// added to its outgoing metadata.
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md := OutgoingMetadata(ctx)
+	for k, v := range NewMetadata(kv...) {
+		md[k] = v
+	}
+	return NewOutgoingContext(ctx, md)
+}
+
+// OutgoingMetadata returns a copy of the outgoing metadata of ctx, which is
+// never nil.
+func OutgoingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(outgoingKey{}).(Metadata)
+	return md.Copy()
+}
+
+// IncomingMetadata returns the metadata received with the request, ctx is the
+// context passed to the handler.
+func IncomingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(incomingKey{}).(Metadata)
+	return md.Copy()
+}
+
+func newIncomingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
@@ -0,0 +1,278 @@
+package rpch
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefBuckets are the default buckets of latency histograms in seconds.
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	sideServer = "server"
+	sideClient = "client"
+)
+
+// Metrics collects the telemetry of servers and clients, and exposes it in
+// Prometheus text format by ServeHTTP. Set it to Server.Metrics, or pass it to
+// Dial by WithMetrics. Several servers and clients can share one Metrics.
+//
+//	m := rpch.NewMetrics()
+//	svr.Metrics = m
+//	conn, err := rpch.Dial(addr, rpch.WithMetrics(m))
+//	http.Handle("/metrics", m)
+type Metrics struct {
+	buckets       []float64
+	lock          sync.Mutex
+	requests      map[requestKey]*histogram
+	streamBytes   map[streamKey]int64
+	activeConns   map[string]int64
+	activeStreams map[string]int64
+	//the hedged copies sent and the calls won by them by Service.Method
+	hedges    map[methodKey]int64
+	hedgeWins map[methodKey]int64
+}
+
+type methodKey struct {
+	service string
+	method  string
+}
+
+type requestKey struct {
+	side    string
+	service string
+	method  string
+	code    string
+}
+
+type streamKey struct {
+	side      string
+	service   string
+	method    string
+	direction string
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewMetrics returns a Metrics whose latency histograms use buckets, or
+// DefBuckets if no bucket is given.
+func NewMetrics(buckets ...float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Metrics{
+		buckets:       buckets,
+		requests:      make(map[requestKey]*histogram),
+		streamBytes:   make(map[streamKey]int64),
+		activeConns:   map[string]int64{sideServer: 0, sideClient: 0},
+		activeStreams: map[string]int64{sideServer: 0, sideClient: 0},
+		hedges:        make(map[methodKey]int64),
+		hedgeWins:     make(map[methodKey]int64),
+	}
+}
+
+// the methods below do nothing on a nil Metrics
+
+func (m *Metrics) observeRequest(side, service, method string, code Code, d time.Duration) {
+	if m == nil {
+		return
+	}
+	key := requestKey{side: side, service: service, method: method, code: code.String()}
+	seconds := d.Seconds()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	h, ok := m.requests[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.requests[key] = h
+	}
+	h.count++
+	h.sum += seconds
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+}
+
+func (m *Metrics) addStreamBytes(side, service, method string, in, out int64) {
+	if m == nil || in == 0 && out == 0 {
+		return
+	}
+	m.lock.Lock()
+	m.streamBytes[streamKey{side, service, method, "in"}] += in
+	m.streamBytes[streamKey{side, service, method, "out"}] += out
+	m.lock.Unlock()
+}
+
+func (m *Metrics) addActiveConns(side string, delta int64) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	m.activeConns[side] += delta
+	m.lock.Unlock()
+}
+
+func (m *Metrics) addActiveStreams(side string, delta int64) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	m.activeStreams[side] += delta
+	m.lock.Unlock()
+}
+
+// addHedge counts a hedged copy sent, or a call answered successfully by a
+// hedged copy first if won.
+func (m *Metrics) addHedge(service, method string, won bool) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	if won {
+		m.hedgeWins[methodKey{service, method}]++
+	} else {
+		m.hedges[methodKey{service, method}]++
+	}
+	m.lock.Unlock()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	m.lock.Lock()
+	for _, side := range []string{sideServer, sideClient} {
+		m.writeRequests(&buf, side)
+		m.writeStreamBytes(&buf, side)
+		writeHeader(&buf, "rpch_"+side+"_active_connections", "gauge", "Number of open connections.")
+		fmt.Fprintf(&buf, "rpch_%s_active_connections %d\n", side, m.activeConns[side])
+		writeHeader(&buf, "rpch_"+side+"_active_streams", "gauge", "Number of streams being transferred.")
+		fmt.Fprintf(&buf, "rpch_%s_active_streams %d\n", side, m.activeStreams[side])
+	}
+	writeMethodCounter(&buf, "rpch_client_hedged_requests_total", "Number of hedged copies of calls sent.", m.hedges)
+	writeMethodCounter(&buf, "rpch_client_hedge_wins_total", "Number of calls answered successfully by a hedged copy first.", m.hedgeWins)
+	m.lock.Unlock()
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+func (m *Metrics) writeRequests(buf *bytes.Buffer, side string) {
+	var keys []requestKey
+	for key := range m.requests {
+		if key.side == side {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	total := "rpch_" + side + "_requests_total"
+	writeHeader(buf, total, "counter", "Number of finished requests.")
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s%s %d\n", total, labels("service", key.service, "method", key.method, "code", key.code), m.requests[key].count)
+	}
+	duration := "rpch_" + side + "_request_duration_seconds"
+	writeHeader(buf, duration, "histogram", "Latency of requests in seconds.")
+	for _, key := range keys {
+		h := m.requests[key]
+		for i, bound := range m.buckets {
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", duration, labels("service", key.service, "method", key.method, "code", key.code, "le", le), h.counts[i])
+		}
+		l := labels("service", key.service, "method", key.method, "code", key.code)
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", duration, labels("service", key.service, "method", key.method, "code", key.code, "le", "+Inf"), h.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", duration, l, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(buf, "%s_count%s %d\n", duration, l, h.count)
+	}
+}
+
+func (m *Metrics) writeStreamBytes(buf *bytes.Buffer, side string) {
+	var keys []streamKey
+	for key := range m.streamBytes {
+		if key.side == side {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.direction < b.direction
+	})
+	name := "rpch_" + side + "_stream_bytes_total"
+	writeHeader(buf, name, "counter", "Bytes of stream data received (in) and sent (out).")
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s%s %d\n", name, labels("service", key.service, "method", key.method, "direction", key.direction), m.streamBytes[key])
+	}
+}
+
+func writeMethodCounter(buf *bytes.Buffer, name, help string, counts map[methodKey]int64) {
+	keys := make([]methodKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		return a.method < b.method
+	})
+	writeHeader(buf, name, "counter", help)
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s%s %d\n", name, labels("service", key.service, "method", key.method), counts[key])
+	}
+}
+
+func writeHeader(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats pairs of label name and value.
+func labels(pairs ...string) string {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i != 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(pairs[i])
+		sb.WriteString(`="`)
+		sb.WriteString(labelEscaper.Replace(pairs[i+1]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
@@ -0,0 +1,762 @@
+package rpch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// muxMagic is sent instead of magic by the clients supporting multiplexing. The
+// server answers it with muxMagic, and then both sides send frames:
+//
+//	StreamID(4B) FrameType(1B) Length(4B) Payload
+//
+// Each call of the client opens a new stream, on which the request and the
+// response are sent exactly as on a connection without multiplexing, including
+// the chunked stream data. So calls and streams are interleaved on one
+// connection, and a stream response does not hold the connection.
+const muxMagic = 0x01686A6C
+
+const (
+	// frameData carries the bytes of a stream.
+	frameData = iota
+	// frameWindow allows the peer to send more bytes on a stream, the payload
+	// is the 4B increment.
+	frameWindow
+	// frameClose means the sender sends no more bytes on the stream, like EOF.
+	frameClose
+	// frameReset aborts a stream, no more frames are sent on it. The client
+	// resets the calls it gives up, and the server the streams opened beyond
+	// its stream limit.
+	frameReset
+)
+
+const (
+	frameHeadLen = 9
+	maxFrameSize = 16 << 10
+	// streamWindow is the bytes a stream can send before the peer reads them.
+	streamWindow = 256 << 10
+	// muxHandshakeTimeout bounds the wait for the server to answer muxMagic.
+	muxHandshakeTimeout = 10 * time.Second
+	// defaultMaxStreams is the default of Server.MaxConcurrentStreams.
+	defaultMaxStreams = 100
+)
+
+var (
+	errMuxClosed     = errors.New("rpch: multiplexed connection closed")
+	errBadFrame      = newProtoError("rpch: invalid multiplexing frame")
+	errStreamRefused = Errorf(CodeResourceExhausted, "rpch: too many concurrent streams on the connection")
+	errStreamReset   = errors.New("rpch: stream reset by the client")
+)
+
+// muxSession runs streams over a connection.
+type muxSession struct {
+	rwc    net.Conn
+	r      *bufio.Reader
+	wLock  sync.Mutex
+	lock   sync.Mutex
+	stream map[uint32]*muxStream
+	//pending are the streams opened on the client side which have sent
+	//nothing, and have no id yet
+	pending map[*muxStream]struct{}
+	//the last stream id opened by the client
+	lastID uint32
+	//accept is called with the streams opened by the client, it is nil on the
+	//client side
+	accept func(*muxStream)
+	//maxStreams and idleTimeout are only set on the server side, the session
+	//is closed if it has no stream for idleTimeout
+	maxStreams  int
+	idleTimeout time.Duration
+	//the control frames to send, which are the window increments by stream
+	//and the streams to reset. They are written by writeLoop, since serve
+	//should never block on writing rwc while the peer may be blocked writing
+	//too.
+	windows map[uint32]uint32
+	resets  []uint32
+	wake    chan struct{}
+	done    chan struct{}
+	err     error
+}
+
+func newMuxSession(rwc net.Conn, r *bufio.Reader, accept func(*muxStream)) *muxSession {
+	ms := &muxSession{
+		rwc:     rwc,
+		r:       r,
+		stream:  make(map[uint32]*muxStream),
+		pending: make(map[*muxStream]struct{}),
+		accept:  accept,
+		windows: make(map[uint32]uint32),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go ms.writeLoop()
+	return ms
+}
+
+// open opens a new stream on the client side, whose id is taken by start.
+func (ms *muxSession) open() (*muxStream, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if ms.err != nil {
+		return nil, ms.err
+	}
+	s := newMuxStream(ms, 0)
+	ms.pending[s] = struct{}{}
+	return s, nil
+}
+
+// start takes the id of the client stream s and sends its first frame. The id
+// is taken under wLock, so the server receives the new streams in the order of
+// their ids even if they are opened concurrently. The lock of s should be held,
+// and the session should be failed by the caller if start returns an error.
+// The session fails before the stream ids wrap, after which the Conn should be
+// dialed again.
+func (ms *muxSession) start(s *muxStream, payload []byte) error {
+	ms.wLock.Lock()
+	defer ms.wLock.Unlock()
+	ms.lock.Lock()
+	if ms.err == nil && ms.lastID == math.MaxUint32 {
+		ms.lock.Unlock()
+		return errMuxClosed
+	}
+	if ms.err != nil {
+		ms.lock.Unlock()
+		return ms.err
+	}
+	ms.lastID++
+	s.id = ms.lastID
+	delete(ms.pending, s)
+	ms.stream[s.id] = s
+	ms.lock.Unlock()
+	_, err := ms.rwc.Write(appendFrame(make([]byte, 0, frameHeadLen+len(payload)), s.id, frameData, payload))
+	return err
+}
+
+// serve reads the frames until the connection fails, and then fails all the
+// streams.
+func (ms *muxSession) serve() error {
+	head := make([]byte, frameHeadLen)
+	for {
+		if _, err := io.ReadFull(ms.r, head); err != nil {
+			return ms.fail(err)
+		}
+		id, typ, length := get32(head[:4]), head[4], get32(head[5:9])
+		if length > maxFrameSize {
+			return ms.fail(errBadFrame)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ms.r, payload); err != nil {
+			return ms.fail(err)
+		}
+		s, err := ms.lookup(id, typ)
+		if err != nil {
+			return ms.fail(err)
+		}
+		if s == nil {
+			//the frames of removed or refused streams are dropped
+			continue
+		}
+		switch typ {
+		case frameData:
+			err = s.pushData(payload)
+		case frameWindow:
+			if length != 4 {
+				err = errBadFrame
+				break
+			}
+			s.addSendWindow(int(get32(payload)))
+		case frameClose:
+			s.remoteClose()
+		case frameReset:
+			if ms.accept != nil {
+				s.peerReset(errStreamReset)
+			} else {
+				s.peerReset(errStreamRefused)
+			}
+			ms.remove(s)
+		default:
+			err = errBadFrame
+		}
+		if err != nil {
+			return ms.fail(err)
+		}
+	}
+}
+
+// lookup returns the stream of id, the server accepts the new streams opened
+// by the client, or refuses them beyond maxStreams.
+func (ms *muxSession) lookup(id uint32, typ byte) (*muxStream, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if s, ok := ms.stream[id]; ok {
+		return s, nil
+	}
+	if ms.accept == nil || id <= ms.lastID || typ != frameData {
+		return nil, nil
+	}
+	ms.lastID = id
+	if len(ms.stream) >= ms.maxStreams {
+		//the client keeps opening streams without reading the refusals
+		if len(ms.resets) >= ms.maxStreams {
+			return nil, errStreamRefused
+		}
+		ms.resets = append(ms.resets, id)
+		ms.signal()
+		return nil, nil
+	}
+	s := newMuxStream(ms, id)
+	ms.stream[id] = s
+	if len(ms.stream) == 1 && ms.idleTimeout > 0 {
+		ms.rwc.SetReadDeadline(time.Time{})
+	}
+	ms.accept(s)
+	return s, nil
+}
+
+func (ms *muxSession) remove(s *muxStream) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.pending, s)
+	if ms.stream[s.id] != s {
+		return
+	}
+	delete(ms.stream, s.id)
+	if len(ms.stream) == 0 && ms.idleTimeout > 0 && ms.err == nil {
+		ms.rwc.SetReadDeadline(time.Now().Add(ms.idleTimeout))
+	}
+}
+
+// closed reports whether the session has failed.
+func (ms *muxSession) closed() bool {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.err != nil
+}
+
+func (ms *muxSession) fail(err error) error {
+	ms.lock.Lock()
+	if ms.err != nil {
+		ms.lock.Unlock()
+		return err
+	}
+	ms.err = errMuxClosed
+	streams, pending := ms.stream, ms.pending
+	ms.stream, ms.pending = make(map[uint32]*muxStream), make(map[*muxStream]struct{})
+	close(ms.done)
+	ms.lock.Unlock()
+	//closing rwc first unblocks the writes holding the lock of a stream
+	ms.rwc.Close()
+	for _, s := range streams {
+		s.fail(errMuxClosed)
+	}
+	for s := range pending {
+		s.fail(errMuxClosed)
+	}
+	return err
+}
+
+// signal wakes up writeLoop, the lock should be held.
+func (ms *muxSession) signal() {
+	select {
+	case ms.wake <- struct{}{}:
+	default:
+	}
+}
+
+// queueWindow queues the window increment n of stream id.
+func (ms *muxSession) queueWindow(id uint32, n int) {
+	ms.lock.Lock()
+	if ms.err == nil {
+		ms.windows[id] += uint32(n)
+		ms.signal()
+	}
+	ms.lock.Unlock()
+}
+
+// queueReset queues the reset of stream id.
+func (ms *muxSession) queueReset(id uint32) {
+	ms.lock.Lock()
+	if ms.err == nil {
+		ms.resets = append(ms.resets, id)
+		ms.signal()
+	}
+	ms.lock.Unlock()
+}
+
+// writeLoop writes the queued control frames until the session fails.
+func (ms *muxSession) writeLoop() {
+	for {
+		select {
+		case <-ms.wake:
+		case <-ms.done:
+			return
+		}
+		ms.lock.Lock()
+		windows, resets := ms.windows, ms.resets
+		ms.windows, ms.resets = make(map[uint32]uint32), nil
+		ms.lock.Unlock()
+		var buf []byte
+		for _, id := range resets {
+			buf = appendFrame(buf, id, frameReset, nil)
+		}
+		increment := make([]byte, 4)
+		for id, n := range windows {
+			put32(increment, n)
+			buf = appendFrame(buf, id, frameWindow, increment)
+		}
+		if ms.write(buf) != nil {
+			return
+		}
+	}
+}
+
+func appendFrame(buf []byte, id uint32, typ byte, payload []byte) []byte {
+	head := make([]byte, frameHeadLen)
+	put32(head[:4], id)
+	head[4] = typ
+	put32(head[5:9], uint32(len(payload)))
+	buf = append(buf, head...)
+	return append(buf, payload...)
+}
+
+func (ms *muxSession) writeFrame(id uint32, typ byte, payload []byte) error {
+	return ms.write(appendFrame(make([]byte, 0, frameHeadLen+len(payload)), id, typ, payload))
+}
+
+// write writes the frames in buf, a failed write fails the session.
+func (ms *muxSession) write(buf []byte) error {
+	ms.wLock.Lock()
+	_, err := ms.rwc.Write(buf)
+	ms.wLock.Unlock()
+	if err != nil {
+		ms.fail(err)
+		return errMuxClosed
+	}
+	return nil
+}
+
+// muxStream is a stream of muxSession, which is used as the net.Conn of a call.
+type muxStream struct {
+	session *muxSession
+	id      uint32
+	lock    sync.Mutex
+	cond    *sync.Cond
+	//the bytes received and not read yet
+	buf bytes.Buffer
+	//the bytes read but not given back to the peer by frameWindow
+	consumed int
+	//recvWindow is the bytes the peer is allowed to send, and sendWindow is
+	//the bytes allowed to send to the peer
+	recvWindow int
+	sendWindow int
+	//started is set when the first byte is sent
+	started bool
+	//remoteClosed is set when frameClose is received, writeClosed when it is
+	//sent, and readClosed when the stream is closed locally
+	remoteClosed  bool
+	writeClosed   bool
+	readClosed    bool
+	readDeadline  muxDeadline
+	writeDeadline muxDeadline
+	//onReset is called when the peer resets the stream
+	onReset func()
+	err     error
+}
+
+func newMuxStream(session *muxSession, id uint32) *muxStream {
+	s := &muxStream{session: session, id: id, recvWindow: streamWindow, sendWindow: streamWindow}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// pushData buffers the data received, which should be within the window given
+// to the peer.
+func (s *muxStream) pushData(p []byte) error {
+	s.lock.Lock()
+	if len(p) > s.recvWindow {
+		s.lock.Unlock()
+		return errBadFrame
+	}
+	if s.readClosed {
+		//nobody reads the stream any more, give the window back at once
+		s.lock.Unlock()
+		s.session.queueWindow(s.id, len(p))
+		return nil
+	}
+	s.recvWindow -= len(p)
+	s.buf.Write(p)
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *muxStream) addSendWindow(n int) {
+	s.lock.Lock()
+	s.sendWindow += n
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+func (s *muxStream) remoteClose() {
+	s.lock.Lock()
+	s.remoteClosed = true
+	done := s.readClosed
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	if done {
+		s.session.remove(s)
+	}
+}
+
+func (s *muxStream) fail(err error) {
+	s.lock.Lock()
+	s.err = err
+	s.stopDeadlines()
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+// peerReset fails the stream reset by the peer with err.
+func (s *muxStream) peerReset(err error) {
+	s.fail(err)
+	s.lock.Lock()
+	onReset := s.onReset
+	s.lock.Unlock()
+	if onReset != nil {
+		onReset()
+	}
+}
+
+// notifyReset makes f called when the peer resets the stream, at once if it
+// already has.
+func (s *muxStream) notifyReset(f func()) {
+	s.lock.Lock()
+	reset := s.err == errStreamReset
+	s.onReset = f
+	s.lock.Unlock()
+	if reset {
+		f()
+	}
+}
+
+// reset aborts the stream on the client side, the pending reads and writes
+// fail with err. The server drops the stream, and cancels the context of the
+// call.
+func (s *muxStream) reset(err error) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return
+	}
+	s.err = err
+	started := s.started
+	s.stopDeadlines()
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	if started {
+		s.session.queueReset(s.id)
+	}
+	s.session.remove(s)
+}
+
+// resetOnDone resets the stream once ctx is done, until stop is called. stop
+// reports whether the stream has been reset.
+func (s *muxStream) resetOnDone(ctx context.Context) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	stopped := make(chan struct{})
+	reset := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.reset(ctx.Err())
+			reset <- true
+		case <-stopped:
+			reset <- false
+		}
+	}()
+	return func() bool {
+		close(stopped)
+		return <-reset
+	}
+}
+
+// giveWindow allows the peer to send n more bytes, the lock should be held.
+func (s *muxStream) giveWindow(n int) {
+	s.recvWindow += n
+	s.session.queueWindow(s.id, n)
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.buf.Len() == 0 && !s.remoteClosed && !s.readClosed && s.err == nil && !s.readDeadline.expired {
+		s.cond.Wait()
+	}
+	if s.buf.Len() == 0 {
+		switch {
+		case s.remoteClosed:
+			return 0, io.EOF
+		case s.err != nil:
+			return 0, s.err
+		case s.readClosed:
+			return 0, io.ErrClosedPipe
+		}
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, _ := s.buf.Read(p)
+	s.consumed += n
+	if s.consumed >= streamWindow/2 {
+		s.giveWindow(s.consumed)
+		s.consumed = 0
+	}
+	return n, nil
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		s.lock.Lock()
+		for s.sendWindow == 0 && s.err == nil && !s.writeClosed && !s.writeDeadline.expired {
+			s.cond.Wait()
+		}
+		if s.err != nil || s.writeClosed || s.writeDeadline.expired {
+			err := s.err
+			if err == nil && s.writeClosed {
+				err = io.ErrClosedPipe
+			} else if err == nil {
+				err = os.ErrDeadlineExceeded
+			}
+			s.lock.Unlock()
+			return written, err
+		}
+		n := len(p)
+		if n > s.sendWindow {
+			n = s.sendWindow
+		}
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		s.sendWindow -= n
+		if !s.started && s.session.accept == nil {
+			err := s.session.start(s, p[:n])
+			s.started = err == nil
+			s.lock.Unlock()
+			if err != nil {
+				s.session.fail(err)
+				return written, errMuxClosed
+			}
+			written += n
+			p = p[n:]
+			continue
+		}
+		s.started = true
+		s.lock.Unlock()
+		if err := s.session.writeFrame(s.id, frameData, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// closeWrite sends frameClose, after which the peer reads EOF.
+func (s *muxStream) closeWrite() error {
+	s.lock.Lock()
+	if s.writeClosed || s.err != nil {
+		s.lock.Unlock()
+		return nil
+	}
+	s.writeClosed = true
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	return s.session.writeFrame(s.id, frameClose, nil)
+}
+
+// Close closes both directions of the stream. The bytes received later are
+// dropped, and the stream is removed once the peer closes it too.
+func (s *muxStream) Close() error {
+	s.lock.Lock()
+	started := s.started
+	s.lock.Unlock()
+	if !started && s.session.accept == nil {
+		//the server does not know the stream
+		s.fail(io.ErrClosedPipe)
+		s.session.remove(s)
+		return nil
+	}
+	err := s.closeWrite()
+	s.lock.Lock()
+	if s.readClosed {
+		s.lock.Unlock()
+		return err
+	}
+	s.readClosed = true
+	s.stopDeadlines()
+	unread := s.buf.Len() + s.consumed
+	s.buf.Reset()
+	s.consumed = 0
+	done := s.remoteClosed || s.err != nil
+	if !done && unread > 0 {
+		s.giveWindow(unread)
+	}
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	if done {
+		s.session.remove(s)
+	}
+	return err
+}
+
+func (s *muxStream) LocalAddr() net.Addr  { return s.session.rwc.LocalAddr() }
+func (s *muxStream) RemoteAddr() net.Addr { return s.session.rwc.RemoteAddr() }
+
+func (s *muxStream) SetDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.readDeadline.set(s, t)
+	s.writeDeadline.set(s, t)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.readDeadline.set(s, t)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.writeDeadline.set(s, t)
+	s.lock.Unlock()
+	return nil
+}
+
+// stopDeadlines stops the timers of deadlines, the lock should be held.
+func (s *muxStream) stopDeadlines() {
+	s.readDeadline.set(s, time.Time{})
+	s.writeDeadline.set(s, time.Time{})
+}
+
+// muxDeadline is a deadline of muxStream, which is guarded by the lock of the
+// stream.
+type muxDeadline struct {
+	timer   *time.Timer
+	expired bool
+}
+
+// set sets the deadline to t, no deadline if t is zero. The waiters of s are
+// woken up when it expires.
+func (d *muxDeadline) set(s *muxStream, t time.Time) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.expired = false
+	if t.IsZero() {
+		return
+	}
+	wait := time.Until(t)
+	if wait <= 0 {
+		d.expired = true
+		s.cond.Broadcast()
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		s.lock.Lock()
+		//the timer may have been replaced by a new deadline
+		if d.timer == timer {
+			d.expired = true
+			s.cond.Broadcast()
+		}
+		s.lock.Unlock()
+	})
+	d.timer = timer
+}
+
+// serveMux serves the streams of a multiplexed connection.
+func (svr *Server) serveMux(c *conn) error {
+	buf := make([]byte, 4)
+	put32(buf, muxMagic)
+	if _, err := c.rwc.Write(buf); err != nil {
+		return err
+	}
+	c.setState(StateIdle)
+	session := newMuxSession(c.rwc, c.bufr, func(s *muxStream) {
+		go svr.handleStream(c, s)
+	})
+	session.maxStreams = svr.MaxConcurrentStreams
+	if session.maxStreams <= 0 {
+		session.maxStreams = defaultMaxStreams
+	}
+	//the read deadline of the handshake is replaced by the idle timeout
+	session.idleTimeout = svr.ReadTimeOut
+	c.rwc.SetReadDeadline(time.Now().Add(svr.ReadTimeOut))
+	err := session.serve()
+	if svr.shuttingDown() {
+		return nil
+	}
+	return err
+}
+
+// handleStream serves the call on a stream of the multiplexed connection
+// parent, which is the same as a request on a connection without multiplexing.
+// The request should be read within ReadTimeOut.
+func (svr *Server) handleStream(parent *conn, s *muxStream) {
+	c := newConn(svr, s, parent.logger)
+	c.parent = parent
+	c.stream = s
+	c.overLimit = parent.overLimit
+	var err error
+	defer func() {
+		if e := recover(); e != nil {
+			svr.logger().Log(LevelError, "panic recovered in stream", F(FieldRemoteAddr, s.RemoteAddr()), F(FieldPanic, e))
+		}
+		if err != nil && err != io.EOF && err != errMuxClosed && !errors.Is(err, errStreamReset) && !svr.shuttingDown() {
+			svr.logger().Log(LevelWarn, "stream closed by error", F(FieldRemoteAddr, s.RemoteAddr()), F(FieldError, err))
+		}
+		s.Close()
+		c.setState(StateIdle)
+		//the client has got the error response of the connection limit
+		if parent.overLimit {
+			parent.close()
+		}
+	}()
+	if err = c.setReadDeadline(); err != nil {
+		return
+	}
+	req, err := c.readRequest()
+	if err != nil {
+		return
+	}
+	c.setState(StateActive)
+	if err = svr.handleRequest(req); err != nil {
+		return
+	}
+	if err = req.finishRequest(); err != nil {
+		return
+	}
+	atomic.AddUint64(&parent.requests, 1)
+}
+
+// requestRead is called once the request except its stream argument is read.
+// The read deadline of a stream only applies to the request, since the stream
+// argument is read as long as the handler needs.
+func (c *conn) requestRead() {
+	if c.parent != nil {
+		c.rwc.SetReadDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,482 @@
+package rpch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type muxTestService struct {
+	once    sync.Once
+	release chan struct{}
+	//entered receives a value when Block is called
+	entered chan struct{}
+}
+
+func (s *muxTestService) Echo(str string) (string, error) {
+	return str, nil
+}
+
+// Block returns after Release is called.
+func (s *muxTestService) Block() (string, error) {
+	s.entered <- struct{}{}
+	<-s.release
+	return "released", nil
+}
+
+func (s *muxTestService) Release() error {
+	s.once.Do(func() { close(s.release) })
+	return nil
+}
+
+func (s *muxTestService) Pipe() (io.ReadWriter, func(), error) {
+	r, w := io.Pipe()
+	return &readWriter{Reader: r, Writer: w}, func() { w.Close() }, nil
+}
+
+func (s *muxTestService) Download(n int32) (io.Reader, func(), error) {
+	return bytes.NewReader(testPayload(int(n))), nil, nil
+}
+
+func (s *muxTestService) Upload(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func testPayload(n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(i * 7)
+	}
+	return buf
+}
+
+func startMuxServer(t *testing.T, configure func(*Server)) (*Server, *muxTestService, string) {
+	t.Helper()
+	svr := NewServer()
+	svr.Logger = NopLogger
+	if configure != nil {
+		configure(svr)
+	}
+	impl := &muxTestService{release: make(chan struct{}), entered: make(chan struct{}, 100)}
+	if err := RegisterImpl(svr, "Mux", impl); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve(l)
+	t.Cleanup(func() {
+		impl.Release()
+		svr.Close()
+	})
+	return svr, impl, l.Addr().String()
+}
+
+func dialMux(t *testing.T, addr string) *Conn {
+	t.Helper()
+	conn, err := Dial(addr, WithMultiplexing(), WithLogger(NopLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestMuxConcurrentCallsWithOpenStream(t *testing.T) {
+	_, _, addr := startMuxServer(t, nil)
+	conn := dialMux(t, addr)
+	if conn.mux == nil {
+		t.Fatal("connection is not multiplexed")
+	}
+	pipe, err := Invoke[io.ReadWriteCloser](conn, "Mux", "Pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipe.Close()
+	//the blocked calls are only released by a later call on the same Conn
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := Invoke[string](conn, "Mux", "Block")
+			errs <- err
+		}()
+	}
+	if got, err := Invoke[string](conn, "Mux", "Echo", "hello"); err != nil || got != "hello" {
+		t.Fatalf("Echo = %q, %v", got, err)
+	}
+	if _, err := Invoke[any](conn, "Mux", "Release"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("blocked calls are not released")
+		}
+	}
+	//the stream opened first still works
+	if _, err := pipe.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(pipe, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("pipe read %q, %v", buf, err)
+	}
+}
+
+// legacyProxy forwards the connections without multiplexing to addr, and
+// closes the ones sending muxMagic like an old server.
+func legacyProxy(t *testing.T, addr string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 4)
+				if _, err := io.ReadFull(c, buf); err != nil || get32(buf) == muxMagic {
+					return
+				}
+				s, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer s.Close()
+				s.Write(buf)
+				go io.Copy(s, c)
+				io.Copy(c, s)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestMuxFallback(t *testing.T) {
+	_, _, addr := startMuxServer(t, nil)
+	conn := dialMux(t, legacyProxy(t, addr))
+	if conn.mux != nil {
+		t.Fatal("connection to an old server is multiplexed")
+	}
+	if got, err := Invoke[string](conn, "Mux", "Echo", "hello"); err != nil || got != "hello" {
+		t.Fatalf("Echo = %q, %v", got, err)
+	}
+}
+
+func TestMuxWindowExhaustion(t *testing.T) {
+	_, _, addr := startMuxServer(t, nil)
+	conn := dialMux(t, addr)
+	const size = 4*streamWindow + 123
+	payload := testPayload(size)
+
+	sum, err := Invoke[string](conn, "Mux", "Upload", io.Reader(bytes.NewReader(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256(payload)); sum != want {
+		t.Fatalf("uploaded hash %s, want %s", sum, want)
+	}
+
+	stream, err := Invoke[io.ReadCloser](conn, "Mux", "Download", int32(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the server is blocked by the window until the stream is read
+	time.Sleep(50 * time.Millisecond)
+	got, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("downloaded %d bytes, not the payload of %d bytes", len(got), size)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxBidirectionalStream(t *testing.T) {
+	_, _, addr := startMuxServer(t, nil)
+	conn := dialMux(t, addr)
+	pipe, err := Invoke[io.ReadWriteCloser](conn, "Mux", "Pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//both sides write more than the windows and the socket buffers at once
+	payload := testPayload(8 * streamWindow)
+	go pipe.Write(payload)
+	got := make([]byte, len(payload))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(pipe, got)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stream is deadlocked")
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("echoed bytes differ from the payload")
+	}
+	if err := pipe.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxSessionFailure(t *testing.T) {
+	svr, impl, addr := startMuxServer(t, nil)
+	conn := dialMux(t, addr)
+	pipe, err := Invoke[io.ReadWriteCloser](conn, "Mux", "Pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipe.Close()
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := Invoke[string](conn, "Mux", "Block")
+		blocked <- err
+	}()
+	<-impl.entered
+	svr.Close()
+	if _, err := pipe.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read the stream of a closed connection")
+	}
+	select {
+	case err := <-blocked:
+		if !conn.broken(err) {
+			t.Fatalf("blocked call got %v, which does not break the connection", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked call is not failed")
+	}
+	if _, err := Invoke[string](conn, "Mux", "Echo", "hello"); err != errMuxClosed {
+		t.Fatalf("call on the closed connection got %v", err)
+	}
+}
+
+func TestMuxStreamLimit(t *testing.T) {
+	_, impl, addr := startMuxServer(t, func(svr *Server) {
+		svr.MaxConcurrentStreams = 2
+	})
+	conn := dialMux(t, addr)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := Invoke[string](conn, "Mux", "Block")
+			errs <- err
+		}()
+	}
+	<-impl.entered
+	<-impl.entered
+	_, err := Invoke[string](conn, "Mux", "Echo", "hello")
+	if ErrorCode(err) != CodeResourceExhausted {
+		t.Fatalf("call beyond the stream limit got %v", err)
+	}
+	impl.Release()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Invoke[string](conn, "Mux", "Echo", "hello"); err != nil {
+		t.Fatalf("call after the streams end got %v", err)
+	}
+}
+
+// rawMuxConn does the handshake of multiplexing on a raw connection.
+func rawMuxConn(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if !handshakeMux(c) {
+		t.Fatal("handshake failed")
+	}
+	return c
+}
+
+// readUntilClosed reads the frames of c until the server closes it.
+func readUntilClosed(t *testing.T, c net.Conn, timeout time.Duration) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(timeout))
+	_, err := io.Copy(io.Discard, c)
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		t.Fatal("connection is not closed by the server")
+	}
+}
+
+func TestMuxFlowControlViolation(t *testing.T) {
+	_, _, addr := startMuxServer(t, nil)
+	c := rawMuxConn(t, addr)
+	//Block does not read the stream, so the data beyond the window is not
+	//allowed
+	var buf []byte
+	buf = appendFrame(buf, 1, frameData, []byte("Mux Block 0 1\r\n"))
+	chunk := make([]byte, maxFrameSize)
+	for sent := 0; sent <= streamWindow; sent += len(chunk) {
+		buf = appendFrame(buf, 1, frameData, chunk)
+	}
+	go c.Write(buf)
+	readUntilClosed(t, c, 5*time.Second)
+}
+
+func TestMuxRequestTimeout(t *testing.T) {
+	_, _, addr := startMuxServer(t, func(svr *Server) {
+		svr.ReadTimeOut = 100 * time.Millisecond
+	})
+	c := rawMuxConn(t, addr)
+	//half a request line, the server closes the stream after ReadTimeOut
+	if _, err := c.Write(appendFrame(nil, 1, frameData, []byte("Mux Echo"))); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	head := make([]byte, frameHeadLen)
+	if _, err := io.ReadFull(c, head); err != nil {
+		t.Fatal(err)
+	}
+	if id, typ := get32(head[:4]), head[4]; id != 1 || typ != frameClose {
+		t.Fatalf("got frame %d of stream %d, want frameClose of stream 1", typ, id)
+	}
+
+	//the session without streams is closed after ReadTimeOut
+	idle := rawMuxConn(t, addr)
+	readUntilClosed(t, idle, 5*time.Second)
+}
+
+func TestMuxStreamIDExhaustion(t *testing.T) {
+	_, _, addr := startMuxServer(t, nil)
+	conn := dialMux(t, addr)
+	conn.mux.lock.Lock()
+	conn.mux.lastID = math.MaxUint32 - 1
+	conn.mux.lock.Unlock()
+	if _, err := Invoke[string](conn, "Mux", "Echo", "last"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Invoke[string](conn, "Mux", "Echo", "wrapped")
+	if err != errMuxClosed || !conn.broken(err) {
+		t.Fatalf("call after the last stream id got %v", err)
+	}
+}
+
+type failingReader struct {
+	n int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("reader failed")
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+func TestMuxBalancerKeepsConnOnStreamError(t *testing.T) {
+	_, _, addr := startMuxServer(t, nil)
+	b := NewBalancer(Addresses(addr), WithDialOptions(WithMultiplexing(), WithLogger(NopLogger)), WithBalancerLogger(NopLogger))
+	defer b.Close()
+	pipe, err := Invoke[io.ReadWriteCloser](b, "Mux", "Pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipe.Close()
+	if _, err := Invoke[string](b, "Mux", "Upload", io.Reader(&failingReader{n: 1000})); err == nil {
+		t.Fatal("upload from a failing reader succeeded")
+	}
+	//the failed stream neither ejects the endpoint nor breaks the other stream
+	if got, err := Invoke[string](b, "Mux", "Echo", "hello"); err != nil || got != "hello" {
+		t.Fatalf("Echo = %q, %v", got, err)
+	}
+	if _, err := pipe.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(pipe, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("pipe read %q, %v", buf, err)
+	}
+}
+
+func TestMuxCallContextCanceled(t *testing.T) {
+	impl, addr := startHedgeServer(t, 5*time.Second)
+	conn := dialMux(t, addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := conn.CallContext(ctx, "Hedge", "Wait")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("the call returned after %v", d)
+	}
+	select {
+	case <-impl.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the context of the handler is not canceled")
+	}
+	if conn.broken(err) {
+		t.Fatal("the aborted call breaks the connection")
+	}
+	if got, err := Invoke[string](conn, "Mux", "Echo", "after"); err != nil || got != "after" {
+		t.Fatalf("Echo = %q, %v", got, err)
+	}
+}
+
+func TestMuxConcurrentStreamOpens(t *testing.T) {
+	_, _, addr := startMuxServer(t, nil)
+	conn := dialMux(t, addr)
+	//the streams opened concurrently send their first frames in any order
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			want := fmt.Sprint(i)
+			got, err := Invoke[string](conn, "Mux", "Echo", want)
+			if err == nil && got != want {
+				err = fmt.Errorf("Echo(%s) = %s", want, got)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package rpch
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ReflectionServiceName is the name of the built-in reflection service, which
+// can be registered by RegisterReflectionService.
+const ReflectionServiceName = "rpch.Reflection"
+
+// the kinds of return value reported by the reflection service
+const (
+	RetKindBuiltin = "builtin"
+	RetKindStream  = "stream"
+	RetKindMessage = "message"
+	RetKindVoid    = "void"
+)
+
+type ServiceList struct {
+	Services []string
+}
+
+type ServiceInfo struct {
+	Name    string
+	Methods []*MethodInfo
+}
+
+type MethodInfo struct {
+	Name string
+	// IDL type names of arguments
+	ArgTypes    []string
+	RetTypeName string
+	RetTypeKind string
+}
+
+type MessageList struct {
+	Messages []*MessageInfo
+}
+
+type MessageInfo struct {
+	Name   string
+	Fields []*FieldInfo
+}
+
+type FieldInfo struct {
+	Name string
+	Type string
+}
+
+type reflectionService struct {
+	svr *Server
+}
+
+// RegisterReflectionService registers the reflection service on svr. It lets
+// clients list the registered services, their methods and the message schemas.
+func RegisterReflectionService(svr *Server) {
+	RegisterMessage("rpch.ServiceList", new(ServiceList))
+	RegisterMessage("rpch.ServiceInfo", new(ServiceInfo))
+	RegisterMessage("rpch.MethodInfo", new(MethodInfo))
+	RegisterMessage("rpch.MessageList", new(MessageList))
+	RegisterMessage("rpch.MessageInfo", new(MessageInfo))
+	RegisterMessage("rpch.FieldInfo", new(FieldInfo))
+	impl := &reflectionService{svr: svr}
+	methods := map[string]*MethodDesc{
+		"ListServices":    BuildMethodDesc(impl, "ListServices", "rpch.ServiceList"),
+		"DescribeService": BuildMethodDesc(impl, "DescribeService", "rpch.ServiceInfo"),
+		"ListMessages":    BuildMethodDesc(impl, "ListMessages", "rpch.MessageList"),
+		"DescribeMessage": BuildMethodDesc(impl, "DescribeMessage", "rpch.MessageInfo"),
+	}
+	svr.Register(&Service{
+		Impl:    impl,
+		Name:    ReflectionServiceName,
+		Methods: methods,
+	})
+}
+
+func (rs *reflectionService) ListServices() (*ServiceList, error) {
+	list := new(ServiceList)
+	rs.svr.services.Range(func(key, _ interface{}) bool {
+		list.Services = append(list.Services, key.(string))
+		return true
+	})
+	sort.Strings(list.Services)
+	return list, nil
+}
+
+func (rs *reflectionService) DescribeService(name string) (*ServiceInfo, error) {
+	iservice, ok := rs.svr.services.Load(name)
+	if !ok {
+		return nil, Errorf(CodeUnimplemented, "rpch: no such service: %s", name)
+	}
+	return describeService(iservice.(*Service)), nil
+}
+
+func (rs *reflectionService) ListMessages() (*MessageList, error) {
+	list := new(MessageList)
+	for name, msg := range registeredMessages() {
+		list.Messages = append(list.Messages, describeMessage(name, reflect.TypeOf(msg)))
+	}
+	sort.Slice(list.Messages, func(i, j int) bool {
+		return list.Messages[i].Name < list.Messages[j].Name
+	})
+	return list, nil
+}
+
+func (rs *reflectionService) DescribeMessage(name string) (*MessageInfo, error) {
+	msg, ok := lookupMessage(name)
+	if !ok {
+		return nil, Errorf(CodeInvalidArgument, "rpch: no such message: %s", name)
+	}
+	return describeMessage(name, reflect.TypeOf(msg)), nil
+}
+
+func describeService(service *Service) *ServiceInfo {
+	info := &ServiceInfo{Name: service.Name}
+	for name, methodDesc := range service.Methods {
+		info.Methods = append(info.Methods, describeMethod(name, methodDesc))
+	}
+	sort.Slice(info.Methods, func(i, j int) bool {
+		return info.Methods[i].Name < info.Methods[j].Name
+	})
+	return info
+}
+
+func describeMethod(name string, methodDesc *MethodDesc) *MethodInfo {
+	info := &MethodInfo{
+		Name:        name,
+		ArgTypes:    []string{},
+		RetTypeName: methodDesc.RetTypeName,
+	}
+	f := methodDesc.MethodType
+	for i := firstArg(f); i < f.NumIn(); i++ {
+		info.ArgTypes = append(info.ArgTypes, typeNameOf(f.In(i)))
+	}
+	switch {
+	case f.NumOut() == 1:
+		info.RetTypeKind = RetKindVoid
+	case methodDesc.RetTypeKind == typeKind_Normal:
+		info.RetTypeKind = RetKindBuiltin
+	case methodDesc.RetTypeKind == typeKind_Stream:
+		info.RetTypeKind = RetKindStream
+	default:
+		info.RetTypeKind = RetKindMessage
+	}
+	return info
+}
+
+func describeMessage(name string, t reflect.Type) *MessageInfo {
+	info := &MessageInfo{Name: name, Fields: []*FieldInfo{}}
+	if t.Kind() != reflect.Struct {
+		return info
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		fieldName := field.Name
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			fieldName = tag
+		}
+		info.Fields = append(info.Fields, &FieldInfo{
+			Name: fieldName,
+			Type: typeNameOf(field.Type),
+		})
+	}
+	return info
+}
@@ -1,9 +1,11 @@
 package rpch
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"reflect"
 )
 
@@ -37,7 +39,7 @@ func (ra *netArg) unMarshal() (*reflect.Value, error) {
 	case typeKind_Message:
 		return ra.messageToGlangType()
 	default:
-		return nil, errInvalidKind
+		return nil, errBadRequestKind
 	}
 }
 
@@ -50,12 +52,15 @@ func (ra *netArg) builtinToGlangType() (*reflect.Value, error) {
 }
 
 func (ra *netArg) messageToGlangType() (*reflect.Value, error) {
-	msg, ok := messageNameIDL2Golang[string(ra.typeName)]
+	msg, ok := lookupMessage(string(ra.typeName))
 	if !ok {
 		return nil, errBadRequestMessage
 	}
 	value := reflect.New(reflect.TypeOf(msg))
-	return &value, json.Unmarshal(ra.data, value.Interface())
+	if err := json.Unmarshal(ra.data, value.Interface()); err != nil {
+		return nil, Errorf(CodeInvalidArgument, "rpch: bad request message %s: %v", ra.typeName, err)
+	}
+	return &value, nil
 }
 
 type readWriter struct {
@@ -63,27 +68,33 @@ type readWriter struct {
 	io.Writer
 }
 
-func (ra *netArg) streamToGlangType() (*reflect.Value, error) {
-	var v reflect.Value
+// openStream prepares the reader or writer of a stream argument. It is done when
+// the argument is read, so the stream can be finished even if the request is
+// rejected before the handler is called.
+func (ra *netArg) openStream() error {
 	switch string(ra.typeName) {
 	case "stream":
-		var rw io.ReadWriter = &readWriter{
-			Reader: &chunkReader{bufr: ra.conn.bufr},
-			Writer: &chunkWriter{w: ra.conn.rwc},
+		rw := &readWriter{
+			Reader: ra.conn.newChunkReader(),
+			Writer: ra.conn.newChunkWriter(),
 		}
 		ra.streamReader = rw
 		ra.streamWriter = rw
-		v = reflect.ValueOf(rw)
 	case "istream":
-		var r io.Reader = &chunkReader{bufr: ra.conn.bufr}
-		ra.streamReader = r
-		v = reflect.ValueOf(r)
+		ra.streamReader = ra.conn.newChunkReader()
 	case "ostream":
-		var w io.Writer = &chunkWriter{w: ra.conn.rwc}
-		ra.streamWriter = w
-		v = reflect.ValueOf(w)
+		ra.streamWriter = ra.conn.newChunkWriter()
 	default:
-		return nil, errBadStreamType
+		return errBadStreamType
+	}
+	return nil
+}
+
+func (ra *netArg) streamToGlangType() (*reflect.Value, error) {
+	//for stream, streamReader and streamWriter are the same readWriter
+	v := reflect.ValueOf(ra.streamReader)
+	if ra.streamReader == nil {
+		v = reflect.ValueOf(ra.streamWriter)
 	}
 	return &v, nil
 }
@@ -105,6 +116,18 @@ func newNetArgReader(conn *conn) *netArgReader {
 // when encountering @headLen consecutive zero,
 //it indicates that ther are no more args. we return io.EOF.
 func (ar *netArgReader) nextArg() (*netArg, error) {
+	arg, err := ar.nextArgHead()
+	if err != nil {
+		return nil, err
+	}
+	arg.data = make([]byte, arg.dataLen)
+	_, err = io.ReadFull(ar.conn.bufr, arg.data)
+	return arg, err
+}
+
+// nextArgHead reads the head and the type name of the next argument, leaving
+// its data unread.
+func (ar *netArgReader) nextArgHead() (*netArg, error) {
 	if err := ar.readHeadBytes(); err != nil {
 		return nil, err
 	}
@@ -118,9 +141,7 @@ func (ar *netArgReader) nextArg() (*netArg, error) {
 	if err := ar.readTypeName(); err != nil {
 		return nil, err
 	}
-	arg.data = make([]byte, arg.dataLen)
-	_, err := io.ReadFull(ar.conn.bufr, arg.data)
-	return arg, err
+	return arg, nil
 }
 
 func (ar *netArgReader) readTypeName() error {
@@ -146,33 +167,116 @@ type request struct {
 	method       string
 	seq          uint64
 	argCnt       uint32
+	metadata     Metadata
+	ctx          context.Context
 	argReader    *netArgReader
+	args         []*netArg
 	streamingArg *netArg
+	//argsLeft is set if the istream or stream argument of a rejected request
+	//is not read, then the connection can not serve the next request
+	argsLeft bool
 }
 
 func (req *request) finishRequest() error {
 	return req.conn.bufw.Flush()
 }
 
-func (req *request) parseArgs() (values []reflect.Value, err error) {
-	var args []*netArg
+// readArgs reads all arguments of the request from the connection. An error
+// returned by it means the connection can not be used anymore.
+func (req *request) readArgs() error {
 	for i := 0; i < int(req.argCnt); i++ {
 		arg, err := req.argReader.nextArg()
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if arg.typeKind == typeKind_Stream {
+			if req.streamingArg != nil {
+				return errMultipleStreamArg
+			}
+			if err = arg.openStream(); err != nil {
+				return err
+			}
 			req.streamingArg = arg
 		}
-		args = append(args, arg)
+		req.args = append(req.args, arg)
 	}
+	return nil
+}
 
+// discardArgs skips the arguments of a rejected request without keeping them.
+// It stops at the istream or stream argument, whose data sent by the client is
+// never read, and sets argsLeft. An ostream argument carries no data, so it is
+// opened to be finished as usual.
+func (req *request) discardArgs() error {
 	for i := 0; i < int(req.argCnt); i++ {
-		value, err := args[i].unMarshal()
+		arg, err := req.argReader.nextArgHead()
+		if err != nil {
+			return err
+		}
+		if arg.typeKind == typeKind_Stream {
+			if req.streamingArg != nil || string(arg.typeName) != "ostream" {
+				req.argsLeft = true
+				return nil
+			}
+			if err := arg.openStream(); err != nil {
+				return err
+			}
+			req.streamingArg = arg
+		}
+		if _, err := io.CopyN(ioutil.Discard, req.conn.bufr, int64(arg.dataLen)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseArgs decodes the arguments and checks them against the method signature,
+// so that reflect.Value.Call will not panic.
+func (req *request) parseArgs(methodType reflect.Type) (values []reflect.Value, err error) {
+	first := firstArg(methodType)
+	if first == 2 {
+		values = append(values, reflect.ValueOf(req.ctx))
+	}
+	for i, arg := range req.args {
+		in := methodType.In(i + first)
+		//check the message type before decoding json
+		if arg.typeKind == typeKind_Message {
+			if msg, ok := lookupMessage(string(arg.typeName)); ok && !reflect.PtrTo(reflect.TypeOf(msg)).AssignableTo(in) {
+				return nil, newArgTypeError(i, in, arg)
+			}
+		}
+		value, err := arg.unMarshal()
 		if err != nil {
 			return nil, err
 		}
+		if !value.Type().AssignableTo(in) {
+			return nil, newArgTypeError(i, in, arg)
+		}
 		values = append(values, *value)
 	}
 	return
 }
+
+func newArgTypeError(i int, expected reflect.Type, arg *netArg) error {
+	return Errorf(CodeInvalidArgument, "rpch: invalid argument %d: expected %s, got %s", i+1, typeNameOf(expected), arg.typeName)
+}
+
+// finishStream makes the stream argument ready for the next request, whether
+// or not the handler has used it.
+func (req *request) finishStream() {
+	if req.streamingArg == nil {
+		return
+	}
+	//consume the rest data in istream if user doesn't do that in handler
+	//otherwise it will affect the parse of the next request
+	if r := req.streamingArg.streamReader; r != nil {
+		io.Copy(ioutil.Discard, r)
+	}
+	// if stream is a ostream, we need to make w(chunkWriter) send an EOF signal to client after
+	// handler, which indicates that there are no more data to be written to ostream.
+	// Only by this, can client know it's time to accept Return Value of registered methods
+	if w := req.streamingArg.streamWriter; w != nil {
+		//it will send 0\r\n\r\n
+		w.Write(nil)
+	}
+}
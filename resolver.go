@@ -0,0 +1,306 @@
+package rpch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Target is a parsed target of DialBalancer in the form of
+// scheme://authority/endpoint, e.g. dns:///svc:8080 has scheme dns, empty
+// authority and endpoint svc:8080.
+type Target struct {
+	Scheme    string
+	Authority string
+	Endpoint  string
+}
+
+// ParseTarget parses s as a Target. A target without scheme such as "host:port"
+// is a static target of a single address.
+func ParseTarget(s string) (Target, error) {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return Target{Scheme: "static", Endpoint: s}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return Target{}, fmt.Errorf("rpch: bad target %q: %v", s, err)
+	}
+	return Target{
+		Scheme:    u.Scheme,
+		Authority: u.Host,
+		Endpoint:  strings.TrimPrefix(u.Path, "/"),
+	}, nil
+}
+
+func (t Target) String() string {
+	return t.Scheme + "://" + t.Authority + "/" + t.Endpoint
+}
+
+// Resolver watches the addresses of a target.
+type Resolver interface {
+	// Close stops watching, update is not called after Close returns.
+	Close()
+}
+
+// ResolverBuilder builds the Resolver of target. The resolver calls update with
+// the full address list whenever it changes, and the first list should be given
+// before the builder returns.
+type ResolverBuilder func(target Target, update func([]Address)) (Resolver, error)
+
+var resolvers = struct {
+	sync.RWMutex
+	builders map[string]ResolverBuilder
+}{builders: make(map[string]ResolverBuilder)}
+
+// RegisterResolver registers the builder of the targets of scheme, replacing the
+// builder registered before. The builtin schemes are static, dns and file.
+func RegisterResolver(scheme string, builder ResolverBuilder) {
+	resolvers.Lock()
+	resolvers.builders[scheme] = builder
+	resolvers.Unlock()
+}
+
+func init() {
+	RegisterResolver("static", staticResolver)
+	RegisterResolver("dns", NewDNSResolverBuilder(30*time.Second))
+	RegisterResolver("file", NewFileResolverBuilder(time.Second))
+}
+
+// DialBalancer makes a Balancer whose addresses are resolved from target, e.g.
+//
+//	rpch.DialBalancer("static:///10.0.0.1:8080,10.0.0.2:8080")
+//	rpch.DialBalancer("dns:///svc.local:8080")
+//	rpch.DialBalancer("file:///etc/rpch/endpoints.json")
+//
+// It returns after the first addresses are dialed. The addresses are updated
+// when the resolver reports changes.
+func DialBalancer(target string, opts ...BalancerOption) (*Balancer, error) {
+	t, err := ParseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	resolvers.RLock()
+	builder, ok := resolvers.builders[t.Scheme]
+	resolvers.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("rpch: no resolver for scheme %q", t.Scheme)
+	}
+	b := newBalancer(opts)
+	//the updates before the builder returns are waited
+	var lock sync.Mutex
+	var initial sync.WaitGroup
+	building := true
+	update := func(addrs []Address) {
+		lock.Lock()
+		defer lock.Unlock()
+		if building {
+			b.update(addrs, &initial)
+		} else {
+			b.update(addrs, nil)
+		}
+	}
+	r, err := builder(t, update)
+	lock.Lock()
+	building = false
+	lock.Unlock()
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	initial.Wait()
+	b.resolver = r
+	return b, nil
+}
+
+type nopResolver struct{}
+
+func (nopResolver) Close() {}
+
+// staticResolver resolves comma-separated addresses.
+func staticResolver(target Target, update func([]Address)) (Resolver, error) {
+	var addrs []string
+	for _, addr := range strings.Split(target.Endpoint, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("rpch: no address in target %s", target)
+	}
+	update(Addresses(addrs...))
+	return nopResolver{}, nil
+}
+
+// pollResolver calls resolve every interval, and updates the addresses if they
+// change.
+type pollResolver struct {
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func startPolling(interval time.Duration, resolve func() ([]Address, error), update func([]Address)) (Resolver, error) {
+	addrs, err := resolve()
+	if err != nil {
+		return nil, err
+	}
+	update(addrs)
+	r := &pollResolver{done: make(chan struct{})}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+			}
+			//keep the last addresses if resolving fails
+			newAddrs, err := resolve()
+			if err != nil || sameAddresses(addrs, newAddrs) {
+				continue
+			}
+			select {
+			case <-r.done:
+				return
+			default:
+			}
+			addrs = newAddrs
+			update(addrs)
+		}
+	}()
+	return r, nil
+}
+
+func (r *pollResolver) Close() {
+	close(r.done)
+	r.wg.Wait()
+}
+
+func sameAddresses(a, b []Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sortAddresses(addrs []Address) {
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].Addr < addrs[j].Addr
+	})
+}
+
+// NewDNSResolverBuilder returns the builder of dns targets which looks up the
+// host every interval. The authority of target is the DNS server to use, e.g.
+// dns://8.8.8.8/svc.local:8080. Register it to change the interval of dns:
+//
+//	rpch.RegisterResolver("dns", rpch.NewDNSResolverBuilder(5*time.Second))
+func NewDNSResolverBuilder(interval time.Duration) ResolverBuilder {
+	return func(target Target, update func([]Address)) (Resolver, error) {
+		host, port, err := net.SplitHostPort(target.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("rpch: bad dns target %s: %v", target, err)
+		}
+		resolver := net.DefaultResolver
+		if server := target.Authority; server != "" {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			resolver = &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, server)
+				},
+			}
+		}
+		resolve := func() ([]Address, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			ips, err := resolver.LookupHost(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			addrs := make([]Address, len(ips))
+			for i, ip := range ips {
+				addrs[i] = Address{Addr: net.JoinHostPort(ip, port), Weight: 1}
+			}
+			sortAddresses(addrs)
+			return addrs, nil
+		}
+		return startPolling(interval, resolve, update)
+	}
+}
+
+// NewFileResolverBuilder returns the builder of file targets which checks the
+// file every interval, and reloads it when it is modified. The file is a JSON
+// array of addresses, and an element can be either a string or an object with
+// the weight:
+//
+//	["10.0.0.1:8080", {"addr": "10.0.0.2:8080", "weight": 2}]
+//
+// A file target has an absolute path, e.g. file:///etc/rpch/endpoints.json.
+func NewFileResolverBuilder(interval time.Duration) ResolverBuilder {
+	return func(target Target, update func([]Address)) (Resolver, error) {
+		path := "/" + target.Endpoint
+		var modTime time.Time
+		var addrs []Address
+		resolve := func() ([]Address, error) {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			if info.ModTime().Equal(modTime) && addrs != nil {
+				return addrs, nil
+			}
+			newAddrs, err := readAddressFile(path)
+			if err != nil {
+				return nil, err
+			}
+			modTime, addrs = info.ModTime(), newAddrs
+			return addrs, nil
+		}
+		return startPolling(interval, resolve, update)
+	}
+}
+
+func readAddressFile(path string) ([]Address, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var elems []json.RawMessage
+	if err = json.Unmarshal(data, &elems); err != nil {
+		return nil, fmt.Errorf("rpch: bad address file %s: %v", path, err)
+	}
+	addrs := make([]Address, 0, len(elems))
+	for _, elem := range elems {
+		var addr Address
+		if err = json.Unmarshal(elem, &addr.Addr); err != nil {
+			if err = json.Unmarshal(elem, &addr); err != nil {
+				return nil, fmt.Errorf("rpch: bad address file %s: %v", path, err)
+			}
+		}
+		if addr.Addr == "" {
+			return nil, fmt.Errorf("rpch: bad address file %s: empty address", path)
+		}
+		addrs = append(addrs, addr)
+	}
+	sortAddresses(addrs)
+	return addrs, nil
+}
@@ -0,0 +1,242 @@
+package rpch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy decides whether and when a failed call is retried. Errors which
+// break the connection, such as connection reset, are treated as
+// CodeUnavailable.
+type RetryPolicy struct {
+	// MaxAttempts is the max number of attempts including the first one, the
+	// call is not retried if it is less than 2.
+	MaxAttempts int
+	// The backoff before the n-th retry is InitialBackoff*BackoffMultiplier^(n-1)
+	// limited by MaxBackoff, and then randomized by ±Jitter (0 to 1) of itself.
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	Jitter            float64
+	// RetryableCodes are the codes of errors to retry.
+	RetryableCodes []Code
+}
+
+// DefaultRetryPolicy retries unavailable and overloaded errors at most twice.
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts:       3,
+	InitialBackoff:    100 * time.Millisecond,
+	MaxBackoff:        time.Second,
+	BackoffMultiplier: 2,
+	Jitter:            0.2,
+	RetryableCodes:    []Code{CodeUnavailable, CodeOverloaded},
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	code := ErrorCode(err)
+	if !IsNonSeriousError(err) {
+		//the Balancer or Conn itself is closed, or the caller gives up
+		if errors.Is(err, errClientClosed) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		code = CodeUnavailable
+	}
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) backoff(retry int, rnd float64) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 1; i < retry; i++ {
+		d *= p.BackoffMultiplier
+		if d > float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	d *= 1 + p.Jitter*(2*rnd-1)
+	return time.Duration(d)
+}
+
+// RetryBudget limits the retries to avoid retry storms when most calls fail. It
+// has at most MaxTokens tokens, each retry takes a token and each successful
+// call gives back Ratio tokens. Calls are retried only when there are more than
+// half of MaxTokens tokens.
+type RetryBudget struct {
+	lock      sync.Mutex
+	maxTokens float64
+	ratio     float64
+	tokens    float64
+}
+
+// NewRetryBudget returns a full RetryBudget, e.g. NewRetryBudget(10, 0.1) allows
+// 5 retries in a row, and then a retry every 10 successes.
+func NewRetryBudget(maxTokens, ratio float64) *RetryBudget {
+	return &RetryBudget{maxTokens: maxTokens, ratio: ratio, tokens: maxTokens}
+}
+
+func (rb *RetryBudget) onSuccess() {
+	if rb == nil {
+		return
+	}
+	rb.lock.Lock()
+	if rb.tokens += rb.ratio; rb.tokens > rb.maxTokens {
+		rb.tokens = rb.maxTokens
+	}
+	rb.lock.Unlock()
+}
+
+// takeRetry reports whether a retry is allowed, and takes a token if it is.
+func (rb *RetryBudget) takeRetry() bool {
+	if rb == nil {
+		return true
+	}
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	if rb.tokens <= rb.maxTokens/2 {
+		return false
+	}
+	rb.tokens--
+	return true
+}
+
+// RetryConfig configures RetryCaller.
+type RetryConfig struct {
+	// Policies are the policies by "Service.Method" or "Service", the calls
+	// matching neither use Default. Calls without policy are not retried.
+	Policies map[string]*RetryPolicy
+	Default  *RetryPolicy
+	// Budget is shared by all calls if it is not nil.
+	Budget *RetryBudget
+}
+
+// RetryCaller retries the failed calls of the Caller it wraps, which is usually
+// a Balancer since a Conn can not be used after its connection breaks.
+//
+// A call with a stream argument is not retried once any byte of the stream has
+// been read or written, and a call returning a stream is never retried after it
+// succeeds.
+type RetryCaller struct {
+	caller Caller
+	config RetryConfig
+	lock   sync.Mutex
+	rand   *rand.Rand
+}
+
+func NewRetryCaller(caller Caller, config RetryConfig) *RetryCaller {
+	return &RetryCaller{
+		caller: caller,
+		config: config,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (rc *RetryCaller) policy(service, method string) *RetryPolicy {
+	if p, ok := rc.config.Policies[service+"."+method]; ok {
+		return p
+	}
+	if p, ok := rc.config.Policies[service]; ok {
+		return p
+	}
+	return rc.config.Default
+}
+
+func (rc *RetryCaller) Call(service, method string, args ...*RequestArg) (interface{}, error) {
+	return rc.CallContext(context.Background(), service, method, args...)
+}
+
+func (rc *RetryCaller) CallContext(ctx context.Context, service, method string, args ...*RequestArg) (interface{}, error) {
+	p := rc.policy(service, method)
+	if p == nil || p.MaxAttempts < 2 {
+		return rc.caller.CallContext(ctx, service, method, args...)
+	}
+	args, sent := trackStreamArgs(args)
+	for attempt := 1; ; attempt++ {
+		resp, err := rc.caller.CallContext(ctx, service, method, args...)
+		if err == nil {
+			rc.config.Budget.onSuccess()
+			return resp, err
+		}
+		if !p.retryable(err) || attempt >= p.MaxAttempts || atomic.LoadInt32(sent) != 0 {
+			return resp, err
+		}
+		rc.lock.Lock()
+		rnd := rc.rand.Float64()
+		rc.lock.Unlock()
+		timer := time.NewTimer(p.backoff(attempt, rnd))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, err
+		case <-timer.C:
+		}
+		if !rc.config.Budget.takeRetry() {
+			return resp, err
+		}
+	}
+}
+
+// trackStreamArgs replaces the stream argument with the one setting sent to 1
+// when any byte is read or written.
+func trackStreamArgs(args []*RequestArg) ([]*RequestArg, *int32) {
+	sent := new(int32)
+	for i, arg := range args {
+		if arg.TypeKind != typeKind_Stream {
+			continue
+		}
+		tracked := *arg
+		switch data := arg.Data.(type) {
+		case io.ReadWriter:
+			tracked.Data = &trackingReadWriter{trackingReader{data, sent}, trackingWriter{data, sent}}
+		case io.Reader:
+			tracked.Data = &trackingReader{data, sent}
+		case io.Writer:
+			tracked.Data = &trackingWriter{data, sent}
+		}
+		args = append([]*RequestArg(nil), args...)
+		args[i] = &tracked
+		break
+	}
+	return args, sent
+}
+
+type trackingReader struct {
+	r    io.Reader
+	sent *int32
+}
+
+func (tr *trackingReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		atomic.StoreInt32(tr.sent, 1)
+	}
+	return n, err
+}
+
+type trackingWriter struct {
+	w    io.Writer
+	sent *int32
+}
+
+func (tw *trackingWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		atomic.StoreInt32(tw.sent, 1)
+	}
+	return tw.w.Write(p)
+}
+
+type trackingReadWriter struct {
+	trackingReader
+	trackingWriter
+}
@@ -1,22 +1,80 @@
 package rpch
 
 import (
+	"context"
 	"errors"
 	"io"
-	"io/ioutil"
-	"log"
 	"net"
 	"reflect"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
 	ReadTimeOut  time.Duration
 	WriteTimeOut time.Duration
-	services     sync.Map
+	// LogPanicStack makes the server log the stack trace when a handler panics.
+	LogPanicStack bool
+	// PanicHandler is called with the recovered value and the stack trace when a
+	// handler panics. The client always gets an error response with CodeInternal.
+	PanicHandler func(service, method string, v interface{}, stack []byte)
+	// Metrics collects the telemetry of the server if it is not nil.
+	Metrics *Metrics
+	// Tracer starts a span for each request if it is not nil, as the child of
+	// the span propagated by the client.
+	Tracer *Tracer
+	// Logger receives the logs of the server, DefaultLogger is used if it is nil.
+	Logger Logger
+	// AccessLog makes the server log every request at LevelInfo.
+	AccessLog bool
+	// ConnState is called when a connection changes state, see ConnState. It
+	// is called synchronously, so it can close the connection before the
+	// request is handled.
+	ConnState func(net.Conn, ConnState)
+	// Limiter limits the connections and requests of the server if it is not
+	// nil.
+	Limiter *Limiter
+	// AdaptiveLimiter sheds the requests beyond the concurrency adapted to the
+	// latency of handlers if it is not nil.
+	AdaptiveLimiter *AdaptiveLimiter
+	// Authenticator authenticates the bearer tokens of requests, and
+	// AuthPolicy authorizes the calls. With only Authenticator, all requests
+	// need a valid token; with only AuthPolicy, all requests are anonymous.
+	// Requests are authenticated before their arguments are read. The
+	// arguments of a rejected request are discarded, and if it has an istream
+	// or stream argument, the connection is closed after the error response.
+	Authenticator Authenticator
+	AuthPolicy    *AuthPolicy
+	// MaxConcurrentStreams is the max number of streams of a multiplexed
+	// connection at the same time, 100 by default. The streams beyond it are
+	// refused with CodeResourceExhausted.
+	MaxConcurrentStreams int
+	// ShutdownDrainDelay is how long Shutdown keeps serving after calling the
+	// functions registered by RegisterOnShutdown, which set the health statuses
+	// to not serving, so that the load balancers stop routing to the server
+	// before the listeners and connections are closed. Close does not wait.
+	ShutdownDrainDelay time.Duration
+	services           sync.Map
+	//lock guards conns, listeners, onShutdown and shutdownAt
+	lock       sync.Mutex
+	conns      map[*conn]struct{}
+	listeners  map[net.Listener]struct{}
+	onShutdown []func()
+	shutdownAt time.Time
+	inShutdown int32
 }
 
+// the values of Server.inShutdown
+const (
+	shutdownNone int32 = iota
+	//the server is still serving in the drain delay
+	shutdownDraining
+	//the listeners are closed and the connections are being closed
+	shutdownClosing
+)
+
 var DefaultServer = NewServer()
 
 func NewServer() *Server {
@@ -26,6 +84,13 @@ func NewServer() *Server {
 	}
 }
 
+func (svr *Server) logger() Logger {
+	if svr.Logger != nil {
+		return svr.Logger
+	}
+	return DefaultLogger
+}
+
 func (svr *Server) ListenAndServe(addr string) error {
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -35,11 +100,20 @@ func (svr *Server) ListenAndServe(addr string) error {
 	return svr.Serve(l)
 }
 
+// Serve accepts connections on l until l is closed or the server is shut down,
+// in which case ErrServerClosed is returned.
 func (svr *Server) Serve(l net.Listener) error {
+	if !svr.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer svr.trackListener(l, false)
 	var tempDelay time.Duration
 	for {
 		rwc, err := l.Accept()
 		if err != nil {
+			if svr.shuttingDown() {
+				return ErrServerClosed
+			}
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -49,30 +123,153 @@ func (svr *Server) Serve(l net.Listener) error {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
+				svr.logger().Log(LevelWarn, "accept error", F(FieldError, err), F("retry_in", tempDelay))
 				time.Sleep(tempDelay)
 				continue
 			}
 			return err
 		}
 		tempDelay = 0
-		c := newConn(svr, rwc)
+		c := newConn(svr, rwc, svr.logger())
+		c.overLimit = !svr.Limiter.acquireConn()
+		svr.trackConn(c, true)
+		c.setState(StateNew)
 		go func() {
+			svr.Metrics.addActiveConns(sideServer, 1)
+			defer svr.Metrics.addActiveConns(sideServer, -1)
+			defer svr.Limiter.releaseConn()
 			err := svr.handleConn(c)
-			if err != nil && err != io.EOF {
-				log.Println(err)
+			if err != nil && err != io.EOF && !svr.shuttingDown() {
+				svr.logger().Log(LevelWarn, "connection closed by error", F(FieldRemoteAddr, rwc.RemoteAddr()), F(FieldError, err))
 			}
 		}()
 	}
 }
 
+func (svr *Server) trackListener(l net.Listener, add bool) bool {
+	svr.lock.Lock()
+	defer svr.lock.Unlock()
+	if add {
+		if atomic.LoadInt32(&svr.inShutdown) != shutdownNone {
+			return false
+		}
+		if svr.listeners == nil {
+			svr.listeners = make(map[net.Listener]struct{})
+		}
+		svr.listeners[l] = struct{}{}
+	} else {
+		delete(svr.listeners, l)
+	}
+	return true
+}
+
+// shuttingDown reports whether the connections are being closed, which is
+// after the drain delay of Shutdown.
+func (svr *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&svr.inShutdown) == shutdownClosing
+}
+
+// RegisterOnShutdown registers a function to call when Shutdown or Close is
+// called, before the drain delay and the listeners are closed.
+func (svr *Server) RegisterOnShutdown(f func()) {
+	svr.lock.Lock()
+	svr.onShutdown = append(svr.onShutdown, f)
+	svr.lock.Unlock()
+}
+
+// startShutdown marks the server draining and calls the functions registered
+// by RegisterOnShutdown.
+func (svr *Server) startShutdown() {
+	if !atomic.CompareAndSwapInt32(&svr.inShutdown, shutdownNone, shutdownDraining) {
+		return
+	}
+	svr.lock.Lock()
+	svr.shutdownAt = time.Now()
+	hooks := svr.onShutdown
+	svr.lock.Unlock()
+	for _, f := range hooks {
+		f()
+	}
+}
+
+// closeListeners ends the drain delay and closes the listeners.
+func (svr *Server) closeListeners() {
+	atomic.StoreInt32(&svr.inShutdown, shutdownClosing)
+	svr.lock.Lock()
+	for l := range svr.listeners {
+		l.Close()
+	}
+	svr.lock.Unlock()
+}
+
+// Shutdown gracefully shuts down the server: it calls the functions registered
+// by RegisterOnShutdown and keeps serving for ShutdownDrainDelay, then closes
+// the listeners and the idle connections, and waits for the other connections
+// to finish the current request. If ctx is done before that, Shutdown returns
+// ctx.Err() and the rest connections are left open, which can be closed by
+// Close.
+func (svr *Server) Shutdown(ctx context.Context) error {
+	svr.startShutdown()
+	svr.lock.Lock()
+	drain := time.Until(svr.shutdownAt.Add(svr.ShutdownDrainDelay))
+	svr.lock.Unlock()
+	if drain > 0 && !svr.shuttingDown() {
+		timer := time.NewTimer(drain)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			svr.closeListeners()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	svr.closeListeners()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if svr.closeConns(true) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes the listeners and all connections immediately.
+func (svr *Server) Close() error {
+	svr.startShutdown()
+	svr.closeListeners()
+	svr.closeConns(false)
+	return nil
+}
+
+// closeConns closes the connections, or only the idle ones if idleOnly is true.
+// It returns the number of live connections.
+func (svr *Server) closeConns(idleOnly bool) int {
+	svr.lock.Lock()
+	defer svr.lock.Unlock()
+	for c := range svr.conns {
+		state := ConnState(atomic.LoadInt32(&c.state))
+		if !idleOnly || state == StateIdle || state == StateNew {
+			c.close()
+		}
+	}
+	return len(svr.conns)
+}
+
 func (svr *Server) handleConn(conn *conn) error {
 	var err error
 	var req *request
 	defer func() {
 		if e := recover(); e != nil {
-			log.Printf("err recovered, err=%v\n", e)
+			svr.logger().Log(LevelError, "panic recovered in connection", F(FieldRemoteAddr, conn.rwc.RemoteAddr()), F(FieldPanic, e))
 		}
 		conn.close()
+		conn.setState(StateClosed)
+		svr.trackConn(conn, false)
 	}()
 	if err = conn.setReadDeadline(); err != nil {
 		return err
@@ -81,57 +278,216 @@ func (svr *Server) handleConn(conn *conn) error {
 	if err != nil {
 		return err
 	}
+	if _magic == muxMagic {
+		return svr.serveMux(conn)
+	}
 	if magic != _magic {
 		return errInvalidMagic
 	}
+	conn.setState(StateIdle)
 	for {
 		req, err = conn.readRequest()
 		if err != nil {
 			return err
 		}
+		conn.setState(StateActive)
 		if err = svr.handleRequest(req); err != nil {
 			return err
 		}
 		if err = req.finishRequest(); err != nil {
 			return err
 		}
+		atomic.AddUint64(&conn.requests, 1)
+		//the client has got the error response of the connection limit or
+		//the authentication, after which the stream argument left is not read
+		if conn.overLimit || req.argsLeft || svr.shuttingDown() {
+			return nil
+		}
+		conn.setState(StateIdle)
 	}
 }
 
+// handleRequest only returns the errors that break the connection. Other errors
+// are sent to the client as error responses.
+//
+// Handlers taking a context.Context as the first argument get the context of the
+// request, which carries the metadata and the span of the request. The context
+// is canceled when the response is sent, or when the client resets the stream
+// of the request on a multiplexed connection.
 func (svr *Server) handleRequest(req *request) error {
+	start := time.Now()
+	span := svr.Tracer.start(SpanKindServer, req.service, req.method, extractSpanContext(req.metadata), req.conn.rwc.RemoteAddr())
+	ctx, cancel := context.WithCancel(newIncomingContext(context.Background(), req.metadata))
+	defer cancel()
+	if req.conn.stream != nil {
+		req.conn.stream.notifyReset(cancel)
+	}
+	if span != nil {
+		span.setSeq(req.seq)
+		ctx = ContextWithSpan(ctx, span)
+	}
+	req.ctx = ctx
+	//the request is authenticated before its arguments are read, so that an
+	//unauthenticated client can not make the server read them
+	authErr := svr.authenticate(req)
+	if authErr != nil {
+		if err := req.discardArgs(); err != nil {
+			return err
+		}
+	} else if err := req.readArgs(); err != nil {
+		return err
+	}
+	req.conn.requestRead()
+	in, out := req.conn.streamBytes()
+	if req.streamingArg != nil {
+		svr.Metrics.addActiveStreams(sideServer, 1)
+		req.conn.setState(StateStreaming)
+	}
+	var rtns []reflect.Value
+	var methodDesc *MethodDesc
+	release, err := svr.admit(req, authErr)
+	if err == nil {
+		rtns, methodDesc, err = svr.callMethod(req)
+		release()
+	} else {
+		methodDesc = svr.lookupMethod(req.service, req.method)
+	}
+	req.finishStream()
+	if req.streamingArg != nil {
+		svr.Metrics.addActiveStreams(sideServer, -1)
+		req.conn.setState(StateActive)
+	}
+	//the names of non-existent services or methods are not used as labels
+	service, method := "unknown", "unknown"
+	if methodDesc != nil {
+		service, method = req.service, req.method
+	}
+	//rpcErr is the error sent to the client
+	var rpcErr error
+	defer func() {
+		duration := time.Since(start)
+		svr.Metrics.observeRequest(sideServer, service, method, ErrorCode(rpcErr), duration)
+		if svr.AccessLog {
+			fields := []Field{
+				F(FieldRemoteAddr, req.conn.rwc.RemoteAddr()),
+				F(FieldService, req.service),
+				F(FieldMethod, req.method),
+				F(FieldSeq, req.seq),
+				F(FieldDuration, duration),
+				F(FieldCode, ErrorCode(rpcErr)),
+			}
+			if rpcErr != nil {
+				fields = append(fields, F(FieldError, rpcErr))
+			}
+			svr.logger().Log(LevelInfo, "request", fields...)
+		}
+		in2, out2 := req.conn.streamBytes()
+		svr.Metrics.addStreamBytes(sideServer, service, method, in2-in, out2-out)
+		if span != nil {
+			span.finish(rpcErr)
+		}
+	}()
+	if err != nil {
+		if !IsNonSeriousError(err) {
+			return err
+		}
+		rpcErr = err
+		return req.conn.sendErrorResponse(err, req.seq)
+	}
+	rpcErr = rtnError(rtns)
+	return req.conn.sendResponse(rtns, methodDesc, req.seq)
+}
+
+// rtnError returns the error returned by handler, which is the last return value.
+func rtnError(rtns []reflect.Value) error {
+	if err := rtns[len(rtns)-1].Interface(); err != nil {
+		return err.(error)
+	}
+	return nil
+}
+
+// admit checks the limits of the server before the request is handled. authErr
+// is the error of authenticating the request.
+func (svr *Server) admit(req *request, authErr error) (release func(), err error) {
+	if req.conn.overLimit {
+		return func() {}, Errorf(CodeResourceExhausted, "rpch: too many connections")
+	}
+	if authErr != nil {
+		return func() {}, authErr
+	}
+	limited, err := svr.Limiter.admit(req)
+	if err != nil {
+		return limited, err
+	}
+	adapted, err := svr.AdaptiveLimiter.admit(req)
+	if err != nil {
+		limited()
+		return func() {}, err
+	}
+	return func() {
+		adapted()
+		limited()
+	}, nil
+}
+
+func (svr *Server) lookupMethod(service, method string) *MethodDesc {
+	iservice, ok := svr.services.Load(service)
+	if !ok {
+		return nil
+	}
+	return iservice.(*Service).Methods[method]
+}
+
+func (svr *Server) callMethod(req *request) ([]reflect.Value, *MethodDesc, error) {
 	iservice, ok := svr.services.Load(req.service)
 	if !ok {
-		return errBadRequestService
+		return nil, nil, errBadRequestService
 	}
 	service := iservice.(*Service)
 	methodDesc, ok := service.Methods[req.method]
 	if !ok {
-		return errBadRequestMethod
+		return nil, nil, errBadRequestMethod
 	}
-	//NumIn还包括receiver这个参数，所以+1
-	if methodDesc.MethodType.NumIn() != int(req.argCnt)+1 {
-		return errBadRequestArgCnt
+	//NumIn还包括receiver这个参数，以及可能有的context.Context
+	if methodDesc.MethodType.NumIn() != int(req.argCnt)+firstArg(methodDesc.MethodType) {
+		return nil, methodDesc, errBadRequestArgCnt
 	}
-	values, err := req.parseArgs()
+	values, err := req.parseArgs(methodDesc.MethodType)
 	if err != nil {
-		return err
+		return nil, methodDesc, err
 	}
-	rtns := methodDesc.Method.Call(values)
-	if req.streamingArg != nil {
-		//consume the rest data in istream if user doesn't do that in handler
-		//otherwise it will affect the parse of the next request
-		if r := req.streamingArg.streamReader; r != nil {
-			io.Copy(ioutil.Discard, r)
+	rtns, err := svr.invoke(req, methodDesc, values)
+	return rtns, methodDesc, err
+}
+
+// invoke calls the handler, a panic in it only fails the current request.
+func (svr *Server) invoke(req *request, methodDesc *MethodDesc, values []reflect.Value) (rtns []reflect.Value, err error) {
+	defer func() {
+		e := recover()
+		if e == nil {
+			return
 		}
-		// if stream is a ostream, we need to make w(chunkWriter) send an EOF signal to client after
-		// handler, which indicates that there are no more data to be written to ostream.
-		// Only by this, can client know it's time to accept Return Value of registered methods
-		if w := req.streamingArg.streamWriter; w != nil {
-			//it will send 0\r\n\r\n
-			w.Write(nil)
+		var stack []byte
+		if svr.LogPanicStack || svr.PanicHandler != nil {
+			stack = debug.Stack()
 		}
-	}
-	return req.conn.sendResponse(rtns, methodDesc, req.seq)
+		fields := []Field{
+			F(FieldRemoteAddr, req.conn.rwc.RemoteAddr()),
+			F(FieldService, req.service),
+			F(FieldMethod, req.method),
+			F(FieldSeq, req.seq),
+			F(FieldPanic, e),
+		}
+		if svr.LogPanicStack {
+			fields = append(fields, F(FieldStack, stack))
+		}
+		svr.logger().Log(LevelError, "panic recovered in handler", fields...)
+		if svr.PanicHandler != nil {
+			svr.PanicHandler(req.service, req.method, e, stack)
+		}
+		rtns, err = nil, Errorf(CodeInternal, "rpch: %s.%s panicked", req.service, req.method)
+	}()
+	return methodDesc.Method.Call(values), nil
 }
 
 // A valid method should have at least one and at most three return values.
@@ -206,11 +562,16 @@ func ListenAndServe(addr string) error {
 	return DefaultServer.ListenAndServe(addr)
 }
 
+// Go runs f in a new goroutine, and logs the panic of f to DefaultLogger.
 func Go(f func()) {
+	goLog(DefaultLogger, f)
+}
+
+func goLog(logger Logger, f func()) {
 	go func() {
 		defer func() {
 			if err := recover(); err != nil {
-				log.Printf("panic recovered err: %v\n", err)
+				logger.Log(LevelError, "panic recovered in goroutine", F(FieldPanic, err))
 			}
 		}()
 		f()
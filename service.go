@@ -1,6 +1,11 @@
 package rpch
 
-import "reflect"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
 
 type MethodDesc struct {
 	Method      reflect.Value
@@ -26,3 +31,160 @@ func BuildMethodDesc(v interface{}, method string, retTypeName string) *MethodDe
 		RetTypeKind: GetTypeKind(retTypeName),
 	}
 }
+
+var (
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	funcType    = reflect.TypeOf(func() {})
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// firstArg returns the index of the first IDL argument of method type f. In(0)
+// is the receiver, and In(1) may be a context.Context which is not sent by
+// clients but passed by the server.
+func firstArg(f reflect.Type) int {
+	if f.NumIn() > 1 && f.In(1) == contextType {
+		return 2
+	}
+	return 1
+}
+
+// RegisterImpl registers the exported methods of impl as a service on svr
+// without IDL. The IDL types are inferred from the method signatures:
+//   - builtin types such as int32 and string are used as they are
+//   - pointers to structs are messages named by the struct name, which are
+//     registered automatically
+//   - io.Reader, io.Writer and io.ReadWriter are istream, ostream and stream
+//
+// A method may take a context.Context as the first argument, see Server.
+// The return values should follow the rules of checkServiceValidation, and a
+// method returning stream must return (stream, func(), error).
+func RegisterImpl(svr *Server, name string, impl interface{}) error {
+	if impl == nil {
+		return errors.New("rpch: register a nil impl")
+	}
+	t := reflect.TypeOf(impl)
+	methods := make(map[string]*MethodDesc)
+	messages := make(map[string]reflect.Type)
+	for i := 0; i < t.NumMethod(); i++ {
+		method := t.Method(i)
+		if method.PkgPath != "" {
+			continue
+		}
+		retTypeName, err := inferSignature(method.Type, messages)
+		if err != nil {
+			return fmt.Errorf("rpch: method %s.%s: %v", name, method.Name, err)
+		}
+		methods[method.Name] = BuildMethodDesc(impl, method.Name, retTypeName)
+	}
+	if len(methods) == 0 {
+		return fmt.Errorf("rpch: %T has no exported method", impl)
+	}
+	service := &Service{
+		Impl:    impl,
+		Name:    name,
+		Methods: methods,
+	}
+	if err := checkServiceValidation(service); err != nil {
+		return err
+	}
+	for msgName, msgType := range messages {
+		RegisterMessage(msgName, reflect.New(msgType).Interface())
+	}
+	svr.Register(service)
+	return nil
+}
+
+// inferSignature checks the method type whose first argument is the receiver,
+// and returns the IDL name of its return type.
+func inferSignature(f reflect.Type, messages map[string]reflect.Type) (string, error) {
+	if f.IsVariadic() {
+		return "", errors.New("variadic method is not supported")
+	}
+	var streams int
+	for i := firstArg(f); i < f.NumIn(); i++ {
+		if isStreamType(f.In(i)) {
+			streams++
+			continue
+		}
+		if _, err := inferTypeName(f.In(i), messages); err != nil {
+			return "", fmt.Errorf("argument %d: %v", i, err)
+		}
+	}
+	if streams > 1 {
+		return "", errors.New("should at most have one stream argument")
+	}
+	out := f.NumOut()
+	if out == 0 || !f.Out(out-1).Implements(errorType) {
+		return "", errors.New("last return value should be error")
+	}
+	switch out {
+	case 1:
+		return "", nil
+	case 2:
+		if isStreamType(f.Out(0)) {
+			return "", errors.New("method returning stream should return (stream, func(), error)")
+		}
+		name, err := inferTypeName(f.Out(0), messages)
+		if err != nil {
+			return "", fmt.Errorf("return value: %v", err)
+		}
+		return name, nil
+	case 3:
+		if !isStreamType(f.Out(0)) || f.Out(1) != funcType {
+			return "", errors.New("method with three return values should return (stream, func(), error)")
+		}
+		return typeNameOf(f.Out(0)), nil
+	default:
+		return "", errors.New("should have at most 2 return values besides error")
+	}
+}
+
+func isStreamType(t reflect.Type) bool {
+	return t == readerType || t == writerType || t == readWriterType
+}
+
+// inferTypeName returns the IDL name of builtin or message type t. Messages not
+// registered yet are added to messages.
+func inferTypeName(t reflect.Type, messages map[string]reflect.Type) (string, error) {
+	if builtin, ok := builtinTypes[t.Kind().String()]; ok && builtin == t {
+		return t.Kind().String(), nil
+	}
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return "", fmt.Errorf("unsupported type %s, expected builtin type, stream or pointer to struct", t)
+	}
+	return inferMessage(t.Elem(), messages)
+}
+
+func inferMessage(t reflect.Type, messages map[string]reflect.Type) (string, error) {
+	if name, ok := messageIDLName(t); ok {
+		return name, nil
+	}
+	name := t.Name()
+	if name == "" {
+		return "", fmt.Errorf("anonymous struct %s can not be a message", t)
+	}
+	if msg, ok := lookupMessage(name); ok {
+		return "", fmt.Errorf("message %s is already registered by %T", name, msg)
+	}
+	if msgType, ok := messages[name]; ok {
+		if msgType != t {
+			return "", fmt.Errorf("both %s and %s are named message %s", msgType, t, name)
+		}
+		return name, nil
+	}
+	messages[name] = t
+	//register the messages nested in fields as well, the structs of other
+	//packages such as time.Time are left to json
+	for i := 0; i < t.NumField(); i++ {
+		ft := t.Field(i).Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft.Name() != "" && ft.PkgPath() == t.PkgPath() && t.Field(i).PkgPath == "" {
+			if _, err := inferMessage(ft, messages); err != nil {
+				return "", err
+			}
+		}
+	}
+	return name, nil
+}
@@ -0,0 +1,322 @@
+package rpch
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the metadata keys of W3C trace context
+const (
+	traceparentKey = "traceparent"
+	tracestateKey  = "tracestate"
+)
+
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// FlagSampled is the sampled bit of trace flags.
+const FlagSampled byte = 0x01
+
+// SpanContext is the part of a span propagated to other processes.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+// traceparent formats sc as the traceparent header of version 00.
+func (sc SpanContext) traceparent() string {
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+// parseTraceparent parses the traceparent header. The fields after flags are
+// ignored for versions newer than 00.
+func parseTraceparent(s string) (sc SpanContext, ok bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(make([]byte, 1), []byte(parts[0])); err != nil {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, false
+	}
+	sc.Flags = flags[0]
+	return sc, sc.IsValid()
+}
+
+type SpanKind string
+
+const (
+	SpanKindClient SpanKind = "client"
+	SpanKindServer SpanKind = "server"
+)
+
+// the attribute keys set by rpch
+const (
+	AttrService  = "rpc.service"
+	AttrMethod   = "rpc.method"
+	AttrSeq      = "rpc.seq"
+	AttrPeerAddr = "net.peer.addr"
+)
+
+// Span records a client call or a server handler.
+type Span struct {
+	Context SpanContext
+	// Parent is the SpanID of the parent span, which is invalid for root spans.
+	Parent     SpanID
+	Name       string
+	Kind       SpanKind
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	// Code and Message are the status of the call.
+	Code    Code
+	Message string
+
+	lock   sync.Mutex
+	tracer *Tracer
+}
+
+// SetAttribute sets an attribute of the span, it can be called by handlers on
+// the span got from SpanFromContext.
+func (s *Span) SetAttribute(key, value string) {
+	s.lock.Lock()
+	s.Attributes[key] = value
+	s.lock.Unlock()
+}
+
+// finish ends the span with the status of err and exports it if it is sampled.
+func (s *Span) finish(err error) {
+	s.lock.Lock()
+	s.End = time.Now()
+	s.Code = ErrorCode(err)
+	if err != nil {
+		s.Message = err.Error()
+	}
+	s.lock.Unlock()
+	if s.Context.IsSampled() && s.tracer.Exporter != nil {
+		s.tracer.Exporter.ExportSpan(s)
+	}
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a context carrying span, the calls made with it are
+// the children of span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span carried by ctx, or nil. The context passed to
+// handlers carries the server span if the server has a Tracer.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanExporter receives the finished spans, it should not modify them.
+type SpanExporter interface {
+	ExportSpan(span *Span)
+}
+
+// Tracer starts a span for each client call and server handler, and propagates
+// the W3C trace context in request metadata. Set it to Server.Tracer or pass it
+// to Dial by WithTracer.
+type Tracer struct {
+	// Exporter exports the sampled spans, the spans are only propagated if it
+	// is nil.
+	Exporter SpanExporter
+}
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{Exporter: exporter}
+}
+
+func newSpanID() (id SpanID) {
+	rand.Read(id[:])
+	return
+}
+
+func newTraceID() (id TraceID) {
+	rand.Read(id[:])
+	return
+}
+
+// start starts a span whose parent is parent, or a root span if parent is
+// invalid. It returns nil if t is nil.
+func (t *Tracer) start(kind SpanKind, service, method string, parent SpanContext, peer net.Addr) *Span {
+	if t == nil {
+		return nil
+	}
+	span := &Span{
+		Name:  service + "." + method,
+		Kind:  kind,
+		Start: time.Now(),
+		Attributes: map[string]string{
+			AttrService: service,
+			AttrMethod:  method,
+		},
+		tracer: t,
+	}
+	if peer != nil {
+		span.Attributes[AttrPeerAddr] = peer.String()
+	}
+	if parent.IsValid() {
+		span.Context = parent
+		span.Parent = parent.SpanID
+	} else {
+		span.Context = SpanContext{TraceID: newTraceID(), Flags: FlagSampled}
+	}
+	span.Context.SpanID = newSpanID()
+	return span
+}
+
+func (s *Span) setSeq(seq uint64) {
+	s.SetAttribute(AttrSeq, strconv.FormatUint(seq, 10))
+}
+
+// InMemoryExporter keeps the exported spans in memory, which is useful in tests.
+type InMemoryExporter struct {
+	lock  sync.Mutex
+	spans []*Span
+}
+
+func NewInMemoryExporter() *InMemoryExporter {
+	return new(InMemoryExporter)
+}
+
+func (e *InMemoryExporter) ExportSpan(span *Span) {
+	e.lock.Lock()
+	e.spans = append(e.spans, span)
+	e.lock.Unlock()
+}
+
+// Spans returns the exported spans in the order they finish.
+func (e *InMemoryExporter) Spans() []*Span {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+func (e *InMemoryExporter) Reset() {
+	e.lock.Lock()
+	e.spans = nil
+	e.lock.Unlock()
+}
+
+// StdoutExporter writes each span as a line of JSON. Despite the name, it can
+// write to any io.Writer.
+type StdoutExporter struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+// NewStdoutExporter returns a StdoutExporter writing to w, or os.Stdout if w is nil.
+func NewStdoutExporter(w io.Writer) *StdoutExporter {
+	if w == nil {
+		w = os.Stdout
+	}
+	return &StdoutExporter{enc: json.NewEncoder(w)}
+}
+
+type jsonSpan struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	TraceState string            `json:"trace_state,omitempty"`
+	Name       string            `json:"name"`
+	Kind       SpanKind          `json:"kind"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	DurationUs int64             `json:"duration_us"`
+	Attributes map[string]string `json:"attributes"`
+	Code       string            `json:"code"`
+	Message    string            `json:"message,omitempty"`
+}
+
+func (e *StdoutExporter) ExportSpan(span *Span) {
+	js := &jsonSpan{
+		TraceID:    span.Context.TraceID.String(),
+		SpanID:     span.Context.SpanID.String(),
+		TraceState: span.Context.TraceState,
+		Name:       span.Name,
+		Kind:       span.Kind,
+		Start:      span.Start,
+		End:        span.End,
+		DurationUs: span.End.Sub(span.Start).Microseconds(),
+		Attributes: span.Attributes,
+		Code:       span.Code.String(),
+		Message:    span.Message,
+	}
+	if span.Parent.IsValid() {
+		js.ParentID = span.Parent.String()
+	}
+	e.lock.Lock()
+	e.enc.Encode(js)
+	e.lock.Unlock()
+}
+
+func injectSpanContext(md Metadata, sc SpanContext) {
+	md[traceparentKey] = sc.traceparent()
+	if sc.TraceState != "" {
+		md[tracestateKey] = sc.TraceState
+	}
+}
+
+// extractSpanContext returns the span context in md, which is invalid if md has
+// no valid traceparent.
+func extractSpanContext(md Metadata) SpanContext {
+	sc, ok := parseTraceparent(md[traceparentKey])
+	if !ok {
+		return SpanContext{}
+	}
+	sc.TraceState = md[tracestateKey]
+	return sc
+}